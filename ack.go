@@ -0,0 +1,132 @@
+package kawka
+
+import (
+	"encoding/json"
+
+	websocket "github.com/gobwas/ws"
+)
+
+// Types of the replies sent to clients.
+const (
+	ReplyAck     = "ack"
+	ReplyError   = "error"
+	ReplySpooled = "spooled"
+)
+
+// Error codes of the error replies.
+const (
+	// CodeBadMessage means the message was rejected by the handler.
+	CodeBadMessage = "bad_message"
+
+	// CodeForbidden means the peer is not allowed to use the topic.
+	CodeForbidden = "forbidden"
+
+	// CodeProduceFailed means the message was not produced to Kafka.
+	CodeProduceFailed = "produce_failed"
+
+	// CodeRateLimited means the message exceeded the rate limit.
+	CodeRateLimited = "rate_limited"
+)
+
+// Ack is sent to a client when its message was produced to Kafka.
+type Ack struct {
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Topic     string `json:"topic"`
+	Partition int32  `json:"partition"`
+	Offset    int64  `json:"offset"`
+}
+
+// Spooled is sent to a client when its message could not be produced
+// because Kafka is unavailable and was saved to the spool instead, to be
+// produced later.
+type Spooled struct {
+	Type  string `json:"type"`
+	ID    string `json:"id,omitempty"`
+	Topic string `json:"topic"`
+}
+
+// ErrorReply is sent to a client when its message was not produced, so
+// the client could retry only the failed messages.
+type ErrorReply struct {
+	Type    string `json:"type"`
+	ID      string `json:"id,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// messageID returns the id field of a JSON message, if any.
+func messageID(payload []byte) string {
+	var msg struct {
+		ID string `json:"id"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return ""
+	}
+	return msg.ID
+}
+
+func (wk *Kawka) replyAck(c *conn, id, topic string, partition int32, offset int64) {
+	if !wk.acks {
+		return
+	}
+	wk.reply(c, &Ack{
+		Type:      ReplyAck,
+		ID:        id,
+		Topic:     topic,
+		Partition: partition,
+		Offset:    offset,
+	})
+}
+
+func (wk *Kawka) replySpooled(c *conn, id, topic string) {
+	if !wk.acks {
+		return
+	}
+	wk.reply(c, &Spooled{
+		Type:  ReplySpooled,
+		ID:    id,
+		Topic: topic,
+	})
+}
+
+func (wk *Kawka) replyError(c *conn, id, topic, code string, err error) {
+	if !wk.acks {
+		return
+	}
+	wk.reply(c, &ErrorReply{
+		Type:    ReplyError,
+		ID:      id,
+		Topic:   topic,
+		Code:    code,
+		Message: err.Error(),
+	})
+}
+
+// replyRejected tells the client its message was rejected before it was
+// handled, like when the access to topic is denied. Unlike the other
+// errors it is sent even without acks.
+func (wk *Kawka) replyRejected(c *conn, id string, payload []byte, topic, code string, err error) {
+	if id == "" {
+		id = messageID(payload)
+	}
+	wk.reply(c, &ErrorReply{
+		Type:    ReplyError,
+		ID:      id,
+		Topic:   topic,
+		Code:    code,
+		Message: err.Error(),
+	})
+}
+
+func (wk *Kawka) reply(c *conn, v interface{}) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		wk.logger.Error("error on reply", c.peer.keyvals("err", err)...)
+		return
+	}
+	if err := c.writeMessage(websocket.OpText, data); err != nil && err != errConnClosing {
+		wk.logger.Warn("error on reply", c.peer.keyvals("err", err)...)
+	}
+}
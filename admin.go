@@ -0,0 +1,49 @@
+package kawka
+
+import (
+	"net"
+	"net/http"
+)
+
+// startAdmin serves the metrics and the health checks on the metrics
+// address, if any.
+func (wk *Kawka) startAdmin() error {
+	if wk.metricsAddr == "" {
+		return nil
+	}
+
+	ln, err := net.Listen("tcp", wk.metricsAddr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", wk.MetricsHandler())
+	mux.Handle("/healthz", wk.HealthHandler())
+	mux.Handle("/readyz", wk.ReadyHandler())
+
+	srv := &http.Server{Handler: mux}
+	wk.mu.Lock()
+	wk.admin = srv
+	wk.mu.Unlock()
+
+	go func() {
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			wk.logger.Error("error on metrics server", "addr", wk.metricsAddr, "err", err)
+		}
+	}()
+	return nil
+}
+
+// stopAdmin closes the metrics server. It is kept running during the
+// shutdown, so the draining could be observed and the readiness probe
+// fails meanwhile.
+func (wk *Kawka) stopAdmin() {
+	wk.mu.Lock()
+	srv := wk.admin
+	wk.mu.Unlock()
+
+	if srv != nil {
+		srv.Close()
+	}
+}
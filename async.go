@@ -0,0 +1,167 @@
+package kawka
+
+import (
+	"sync"
+
+	kafka "github.com/Shopify/sarama"
+)
+
+// pipeline keeps the records of one connection produced asynchronously in
+// order: the results are handled in the order the records were sent, and
+// the number of records in flight is bounded.
+type pipeline struct {
+	slots chan struct{}
+	wg    sync.WaitGroup
+
+	// ready passes the results in order to the goroutine replying to
+	// the client. It holds as many results as there are slots, so the
+	// producer results are never blocked by a slow connection.
+	ready chan result
+
+	mu      sync.Mutex
+	sent    uint64
+	handled uint64
+	results map[uint64]result
+}
+
+// result is the outcome of producing a record.
+type result struct {
+	env       *envelope
+	partition int32
+	offset    int64
+	err       error
+}
+
+func newPipeline(maxInFlight int) *pipeline {
+	return &pipeline{
+		slots:   make(chan struct{}, maxInFlight),
+		ready:   make(chan result, maxInFlight),
+		results: make(map[uint64]result),
+	}
+}
+
+// add reserves a slot for a record, blocking while the connection has too
+// many records in flight. It returns the sequence number of the record.
+func (p *pipeline) add() uint64 {
+	p.slots <- struct{}{}
+	p.wg.Add(1)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	seq := p.sent
+	p.sent++
+	return seq
+}
+
+// done stores the result of the record seq and passes the results that
+// are ready to be handled to p.ready, in order.
+func (p *pipeline) done(seq uint64, res result) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.results[seq] = res
+	for {
+		res, ok := p.results[p.handled]
+		if !ok {
+			return
+		}
+		delete(p.results, p.handled)
+		p.handled++
+		p.ready <- res
+	}
+}
+
+// release frees the slot of a handled record.
+func (p *pipeline) release() {
+	<-p.slots
+	p.wg.Done()
+}
+
+// wait blocks until all the records in flight are handled.
+func (p *pipeline) wait() {
+	p.wg.Wait()
+}
+
+// close waits for the records in flight and stops the replies.
+func (p *pipeline) close() {
+	p.wg.Wait()
+	close(p.ready)
+}
+
+// produceAsync sends the record of env to the producer on behalf of c.
+func (wk *Kawka) produceAsync(c *conn, env *envelope) {
+	env.conn = c
+	env.seq = c.pipe.add()
+	wk.producer.Input() <- env.message()
+}
+
+// replyAsync replies to c with the results of its records until the
+// pipeline is closed. The replies and the spooling run here rather than
+// in dispatch, so they never hold up the results of other connections.
+func (wk *Kawka) replyAsync(c *conn) {
+	for res := range c.pipe.ready {
+		wk.complete(c, res.env, res.partition, res.offset, res.err)
+		c.pipe.release()
+	}
+}
+
+// sendMessage produces the record of env and waits for the result.
+func (wk *Kawka) sendMessage(env *envelope) (partition int32, offset int64, err error) {
+	env.errc = make(chan error, 1)
+	msg := env.message()
+	wk.producer.Input() <- msg
+	if err := <-env.errc; err != nil {
+		return -1, -1, err
+	}
+	return msg.Partition, msg.Offset, nil
+}
+
+// dispatch routes the results of the producer back to the senders until
+// the producer is closed.
+func (wk *Kawka) dispatch() {
+	defer close(wk.dispatched)
+
+	successes, failures := wk.producer.Successes(), wk.producer.Errors()
+	for successes != nil || failures != nil {
+		select {
+		case msg, ok := <-successes:
+			if !ok {
+				successes = nil
+				continue
+			}
+			wk.done(msg, nil)
+
+		case perr, ok := <-failures:
+			if !ok {
+				failures = nil
+				continue
+			}
+			wk.done(perr.Msg, perr.Err)
+		}
+	}
+}
+
+func (wk *Kawka) done(msg *kafka.ProducerMessage, err error) {
+	env, ok := msg.Metadata.(*envelope)
+	if !ok {
+		return
+	}
+	if env.errc != nil {
+		env.errc <- err
+		return
+	}
+	if env.conn == nil {
+		if err != nil {
+			wk.logger.Error("error on dead letter", env.peer.keyvals("topic", msg.Topic, "err", err)...)
+		}
+		return
+	}
+
+	env.conn.pipe.done(env.seq, result{
+		env:       env,
+		partition: msg.Partition,
+		offset:    msg.Offset,
+		err:       err,
+	})
+}
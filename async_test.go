@@ -0,0 +1,27 @@
+package kawka
+
+import "testing"
+
+func TestPipelineOrder(t *testing.T) {
+	p := newPipeline(3)
+	for i := 0; i < 3; i++ {
+		p.add()
+	}
+
+	// The results are passed on in order without waiting for them to be
+	// handled, so dispatch never blocks.
+	for _, seq := range []uint64{2, 0, 1} {
+		p.done(seq, result{offset: int64(seq)})
+	}
+
+	var got []int64
+	for i := 0; i < 3; i++ {
+		res := <-p.ready
+		got = append(got, res.offset)
+		p.release()
+	}
+	p.close()
+	if len(got) != 3 || got[0] != 0 || got[1] != 1 || got[2] != 2 {
+		t.Errorf("got %v, want the results in order", got)
+	}
+}
@@ -0,0 +1,65 @@
+package kawka
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errUnauthorized is sent to the clients failed to authenticate.
+// The reason is only logged.
+var errUnauthorized = errors.New("kawka: unauthorized")
+
+// Claims are the verified attributes of an authenticated peer, like the
+// claims of a JWT.
+type Claims map[string]interface{}
+
+// HandshakeRequest is the WebSocket handshake request of a client.
+type HandshakeRequest struct {
+	RemoteAddr string
+	URL        *url.URL
+
+	// Header holds the request headers. The headers of the WebSocket
+	// handshake itself, like Sec-WebSocket-Key, may be missing.
+	Header http.Header
+}
+
+// Token returns the bearer token of the Authorization header or, if
+// there is none, the query parameter param. It is empty if neither is set.
+func (r *HandshakeRequest) Token(param string) string {
+	const prefix = "bearer "
+	if h := r.Header.Get("Authorization"); len(h) > len(prefix) && strings.EqualFold(h[:len(prefix)], prefix) {
+		return strings.TrimSpace(h[len(prefix):])
+	}
+	if param == "" || r.URL == nil {
+		return ""
+	}
+	return r.URL.Query().Get(param)
+}
+
+// Authenticator verifies the identity of a client before the WebSocket
+// handshake completes. Returning a non-nil error rejects the handshake
+// with 401 Unauthorized. The claims are available as Peer.Claims.
+type Authenticator func(req *HandshakeRequest) (Claims, error)
+
+// authenticate runs the authenticator on req.
+// It returns false if the client must be rejected.
+func (wk *Kawka) authenticate(req *HandshakeRequest) (Claims, bool) {
+	if wk.authenticator == nil {
+		return nil, true
+	}
+	claims, err := wk.authenticator(req)
+	if err != nil {
+		wk.metrics.authFailures.Inc(1)
+		wk.logger.Warn("authentication failed", "remote", req.RemoteAddr, "err", err)
+		return nil, false
+	}
+	return claims, true
+}
+
+// writeAuthenticate writes the challenge of a 401 response.
+func writeAuthenticate(w io.Writer) {
+	io.WriteString(w, "WWW-Authenticate: Bearer\r\n")
+}
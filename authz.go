@@ -0,0 +1,81 @@
+package kawka
+
+import (
+	"strconv"
+
+	kafka "github.com/Shopify/sarama"
+)
+
+// HeaderClientSubject is the Kafka record header holding the subject of the
+// verified client certificate. Record headers require Kafka version 0.11
+// or later.
+const HeaderClientSubject = "kawka-client-subject"
+
+// Operation is an action performed by a peer on a topic.
+type Operation int
+
+// Operations checked by an Authorizer.
+const (
+	// OpProduce is writing messages to a topic.
+	OpProduce Operation = iota
+
+	// OpSubscribe is reading messages from a topic.
+	OpSubscribe
+)
+
+func (op Operation) String() string {
+	switch op {
+	case OpProduce:
+		return "produce"
+	case OpSubscribe:
+		return "subscribe"
+	default:
+		return "Operation(" + strconv.Itoa(int(op)) + ")"
+	}
+}
+
+// Access describes an attempt of a peer to use a topic.
+type Access struct {
+	Op    Operation
+	Topic string
+
+	// Type is the type field of the client message being produced.
+	// It is empty for subscriptions and messages without a type.
+	Type string
+}
+
+// Authorizer decides whether peer can access a topic.
+// Returning a non-nil error denies the access.
+type Authorizer func(peer *Peer, access Access) error
+
+// authorize checks the access against the policy and the authorizer,
+// both must allow it.
+func (wk *Kawka) authorize(peer *Peer, access Access) error {
+	err := wk.checkAccess(peer, access)
+	if err != nil {
+		wk.metrics.accessDenied.Inc(1)
+	}
+	return err
+}
+
+func (wk *Kawka) checkAccess(peer *Peer, access Access) error {
+	if wk.policy != nil {
+		if err := wk.policy.Authorize(peer, access); err != nil {
+			return err
+		}
+	}
+	if wk.authorizer == nil {
+		return nil
+	}
+	return wk.authorizer(peer, access)
+}
+
+// peerHeaders returns record headers describing the peer identity.
+func peerHeaders(peer *Peer) []kafka.RecordHeader {
+	if peer.Subject == "" {
+		return nil
+	}
+	return []kafka.RecordHeader{
+		{Key: []byte(HeaderClientSubject), Value: []byte(peer.Subject)},
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/Shopify/sarama"
+	"github.com/cristaloleg/kawka"
+)
+
+// envPrefix prefixes the environment variables named after the flags,
+// for example KAWKA_DEAD_LETTER_TOPIC for -dead-letter-topic.
+const envPrefix = "KAWKA_"
+
+// legacyEnv are the environment variables read before the KAWKA_ ones
+// were introduced.
+var legacyEnv = map[string]string{
+	"brokers":   "KAFKA_PEERS",
+	"sasl-user": "KAFKA_SASL_USER",
+}
+
+var codecs = map[string]sarama.CompressionCodec{
+	"none":   sarama.CompressionNone,
+	"gzip":   sarama.CompressionGZIP,
+	"snappy": sarama.CompressionSnappy,
+	"lz4":    sarama.CompressionLZ4,
+}
+
+// config holds every setting of the command. Each one is set, in order of
+// precedence, by a flag, an environment variable, the config file or its
+// default. The JSON keys are the flag names with underscores.
+type config struct {
+	Addr            string   `json:"addr"`
+	Brokers         list     `json:"brokers"`
+	Topic           string   `json:"topic"`
+	Partition       int      `json:"partition"`
+	Partitioner     string   `json:"partitioner"`
+	LogLevel        string   `json:"log_level"`
+	Verbose         bool     `json:"verbose"`
+	MetricsAddr     string   `json:"metrics_addr"`
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+
+	MaxConnections      int      `json:"max_connections"`
+	MaxConnectionsPerIP int      `json:"max_connections_per_ip"`
+	HandshakeTimeout    duration `json:"handshake_timeout"`
+	MaxFrameSize        int64    `json:"max_frame_size"`
+	MaxMessageSize      int64    `json:"max_message_size"`
+
+	TLSCert     string `json:"tls_cert"`
+	TLSKey      string `json:"tls_key"`
+	TLSClientCA string `json:"tls_client_ca"`
+
+	Deflate                        bool `json:"deflate"`
+	DeflateLevel                   int  `json:"deflate_level"`
+	DeflateServerMaxWindowBits     int  `json:"deflate_server_max_window_bits"`
+	DeflateClientMaxWindowBits     int  `json:"deflate_client_max_window_bits"`
+	DeflateServerNoContextTakeover bool `json:"deflate_server_no_context_takeover"`
+	DeflateClientNoContextTakeover bool `json:"deflate_client_no_context_takeover"`
+
+	Acks            bool   `json:"acks"`
+	Subscriptions   bool   `json:"subscriptions"`
+	Async           int    `json:"async"`
+	DeadLetterTopic string `json:"dead_letter_topic"`
+
+	KafkaVersion    string   `json:"kafka_version"`
+	Compression     string   `json:"compression"`
+	RequiredAcks    int      `json:"required_acks"`
+	ProducerTimeout duration `json:"producer_timeout"`
+	Retries         int      `json:"retries"`
+	RetryBackoff    duration `json:"retry_backoff"`
+	MaxMessageBytes int      `json:"max_message_bytes"`
+	FlushFrequency  duration `json:"flush_frequency"`
+
+	SASLUser         string `json:"sasl_user"`
+	SASLPasswordFile string `json:"sasl_password_file"`
+
+	// SASLPassword has no flag, so it does not show up in the process
+	// list. It is set by KAWKA_SASL_PASSWORD or KAFKA_SASL_PASSWORD.
+	SASLPassword string `json:"sasl_password"`
+
+	KafkaTLS        bool   `json:"kafka_tls"`
+	Certificate     string `json:"certificate"`
+	Key             string `json:"key"`
+	CA              string `json:"ca"`
+	Verify          bool   `json:"verify"`
+	KafkaServerName string `json:"kafka_server_name"`
+
+	JWTHMACKeyFile string   `json:"jwt_hmac_key_file"`
+	JWTRSAKeyFile  string   `json:"jwt_rsa_key_file"`
+	JWTQueryParam  string   `json:"jwt_query_param"`
+	JWTIssuer      string   `json:"jwt_issuer"`
+	JWTAudience    string   `json:"jwt_audience"`
+	JWTLeeway      duration `json:"jwt_leeway"`
+	PolicyFile     string   `json:"policy_file"`
+
+	AllowedOrigins     list `json:"allowed_origins"`
+	AllowMissingOrigin bool `json:"allow_missing_origin"`
+
+	RateLimitConnMessages float64 `json:"rate_limit_conn_messages"`
+	RateLimitConnBytes    float64 `json:"rate_limit_conn_bytes"`
+	RateLimitIPMessages   float64 `json:"rate_limit_ip_messages"`
+	RateLimitIPBytes      float64 `json:"rate_limit_ip_bytes"`
+	RateLimitBurst        float64 `json:"rate_limit_burst"`
+	RateLimitAction       string  `json:"rate_limit_action"`
+
+	SpoolDir           string   `json:"spool_dir"`
+	SpoolMaxBytes      int64    `json:"spool_max_bytes"`
+	SpoolSegmentBytes  int64    `json:"spool_segment_bytes"`
+	SpoolSync          string   `json:"spool_sync"`
+	SpoolSyncInterval  duration `json:"spool_sync_interval"`
+	SpoolRetryInterval duration `json:"spool_retry_interval"`
+}
+
+func defaultConfig() config {
+	return config{
+		Addr:             ":8080",
+		Topic:            "test",
+		Partition:        -1,
+		Partitioner:      "hash",
+		LogLevel:         "info",
+		ShutdownTimeout:  duration(10 * time.Second),
+		HandshakeTimeout: duration(10 * time.Second),
+		MaxMessageSize:   1 << 20,
+		KafkaVersion:     "0.10.0.1",
+		Compression:      "none",
+		RequiredAcks:     int(sarama.WaitForLocal),
+		ProducerTimeout:  duration(10 * time.Second),
+		Retries:          3,
+		RetryBackoff:     duration(100 * time.Millisecond),
+		MaxMessageBytes:  1000000,
+		JWTQueryParam:    "access_token",
+		RateLimitAction:  "delay",
+		Verify:           true,
+		SpoolSync:        "interval",
+	}
+}
+
+func (cfg *config) register(fs *flag.FlagSet) {
+	fs.StringVar(&cfg.Addr, "addr", cfg.Addr, "The address to bind to")
+	fs.Var(&cfg.Brokers, "brokers", "The Kafka brokers to connect to, as a comma separated list")
+	fs.StringVar(&cfg.Topic, "topic", cfg.Topic, "topic name")
+	fs.IntVar(&cfg.Partition, "partition", cfg.Partition, "The partition to produce to, chosen by the partitioner if negative")
+	fs.StringVar(&cfg.Partitioner, "partitioner", cfg.Partitioner, "The partitioner: hash, random, roundrobin, manual or sticky")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "The log level: debug, info, warn or error")
+	fs.BoolVar(&cfg.Verbose, "verbose", cfg.Verbose, "Turn on Sarama logging")
+	fs.StringVar(&cfg.MetricsAddr, "metrics-addr", cfg.MetricsAddr, "The optional address to serve Prometheus metrics and health checks on")
+	fs.Var(&cfg.ShutdownTimeout, "shutdown-timeout", "The time to wait for in-flight messages on shutdown")
+
+	fs.IntVar(&cfg.MaxConnections, "max-connections", cfg.MaxConnections, "The limit of concurrent connections, unlimited if zero")
+	fs.IntVar(&cfg.MaxConnectionsPerIP, "max-connections-per-ip", cfg.MaxConnectionsPerIP, "The limit of concurrent connections from an IP, unlimited if zero")
+	fs.Var(&cfg.HandshakeTimeout, "handshake-timeout", "The time a client has to complete the TLS and WebSocket handshakes, unlimited if zero")
+	fs.Int64Var(&cfg.MaxFrameSize, "max-frame-size", cfg.MaxFrameSize, "The size limit of a client frame, unlimited if zero")
+	fs.Int64Var(&cfg.MaxMessageSize, "max-message-size", cfg.MaxMessageSize, "The size limit of a client message, unlimited if zero")
+
+	fs.StringVar(&cfg.TLSCert, "tls-cert", cfg.TLSCert, "The optional certificate file to serve wss://")
+	fs.StringVar(&cfg.TLSKey, "tls-key", cfg.TLSKey, "The optional key file to serve wss://")
+	fs.StringVar(&cfg.TLSClientCA, "tls-client-ca", cfg.TLSClientCA, "The optional certificate authority file to require client certificates, requires -kafka-version 0.11.0.0 or later")
+
+	fs.BoolVar(&cfg.Deflate, "deflate", cfg.Deflate, "Turn on permessage-deflate compression")
+	fs.IntVar(&cfg.DeflateLevel, "deflate-level", cfg.DeflateLevel, "The compression level of permessage-deflate, the default if zero")
+	fs.IntVar(&cfg.DeflateServerMaxWindowBits, "deflate-server-max-window-bits", cfg.DeflateServerMaxWindowBits, "The window of the messages sent by Kawka, from 8 to 15")
+	fs.IntVar(&cfg.DeflateClientMaxWindowBits, "deflate-client-max-window-bits", cfg.DeflateClientMaxWindowBits, "The window of the messages sent by clients, from 8 to 15")
+	fs.BoolVar(&cfg.DeflateServerNoContextTakeover, "deflate-server-no-context-takeover", cfg.DeflateServerNoContextTakeover, "Reset the compressor of Kawka after each message")
+	fs.BoolVar(&cfg.DeflateClientNoContextTakeover, "deflate-client-no-context-takeover", cfg.DeflateClientNoContextTakeover, "Ask clients to reset their compressor after each message")
+
+	fs.BoolVar(&cfg.Acks, "acks", cfg.Acks, "Reply to every message with an ack or an error")
+	fs.BoolVar(&cfg.Subscriptions, "subscriptions", cfg.Subscriptions, "Let clients subscribe to Kafka topics")
+	fs.IntVar(&cfg.Async, "async", cfg.Async, "Produce asynchronously with at most this many messages in flight per connection")
+	fs.StringVar(&cfg.DeadLetterTopic, "dead-letter-topic", cfg.DeadLetterTopic, "The optional topic for rejected and failed messages, requires -kafka-version 0.11.0.0 or later")
+
+	fs.StringVar(&cfg.KafkaVersion, "kafka-version", cfg.KafkaVersion, "The Kafka protocol version")
+	fs.StringVar(&cfg.Compression, "compression", cfg.Compression, "The compression codec: none, gzip, snappy or lz4")
+	fs.IntVar(&cfg.RequiredAcks, "required-acks", cfg.RequiredAcks, "The acks required from the brokers: 0, 1 or -1 for all in-sync replicas")
+	fs.Var(&cfg.ProducerTimeout, "producer-timeout", "The time the brokers wait for the required acks")
+	fs.IntVar(&cfg.Retries, "retries", cfg.Retries, "The number of times to retry producing a message")
+	fs.Var(&cfg.RetryBackoff, "retry-backoff", "The pause between the retries")
+	fs.IntVar(&cfg.MaxMessageBytes, "max-message-bytes", cfg.MaxMessageBytes, "The size limit of a produced message")
+	fs.Var(&cfg.FlushFrequency, "flush-frequency", "The period of flushing batches to the brokers, zero to flush as fast as possible")
+
+	fs.StringVar(&cfg.SASLUser, "sasl-user", cfg.SASLUser, "The optional SASL/PLAIN user")
+	fs.StringVar(&cfg.SASLPasswordFile, "sasl-password-file", cfg.SASLPasswordFile, "The file with SASL/PLAIN password, KAWKA_SASL_PASSWORD is used if empty")
+
+	fs.BoolVar(&cfg.KafkaTLS, "kafka-tls", cfg.KafkaTLS, "Connect to the Kafka brokers over TLS, implied by -certificate and -ca")
+	fs.StringVar(&cfg.Certificate, "certificate", cfg.Certificate, "The optional certificate file for client authentication")
+	fs.StringVar(&cfg.Key, "key", cfg.Key, "The optional key file for client authentication")
+	fs.StringVar(&cfg.CA, "ca", cfg.CA, "The optional certificate authority file for TLS client authentication")
+	fs.BoolVar(&cfg.Verify, "verify", cfg.Verify, "Optional verify ssl certificates chain")
+	fs.StringVar(&cfg.KafkaServerName, "kafka-server-name", cfg.KafkaServerName, "The optional server name to verify the broker certificates against")
+
+	fs.StringVar(&cfg.JWTHMACKeyFile, "jwt-hmac-key-file", cfg.JWTHMACKeyFile, "The optional file with the secret to verify HS256 client tokens")
+	fs.StringVar(&cfg.JWTRSAKeyFile, "jwt-rsa-key-file", cfg.JWTRSAKeyFile, "The optional PEM file with the public key to verify RS256 client tokens")
+	fs.StringVar(&cfg.JWTQueryParam, "jwt-query-param", cfg.JWTQueryParam, "The query parameter of the client token when there is no Authorization header")
+	fs.StringVar(&cfg.JWTIssuer, "jwt-issuer", cfg.JWTIssuer, "The optional issuer the client tokens must have")
+	fs.StringVar(&cfg.JWTAudience, "jwt-audience", cfg.JWTAudience, "The optional audience the client tokens must have")
+	fs.Var(&cfg.JWTLeeway, "jwt-leeway", "The allowed clock skew when checking the expiry of the client tokens")
+	fs.StringVar(&cfg.PolicyFile, "policy-file", cfg.PolicyFile, "The optional JSON file with the topic access policy")
+	fs.Var(&cfg.AllowedOrigins, "allowed-origins", "The optional comma separated origins allowed to connect, like https://*.example.com")
+	fs.BoolVar(&cfg.AllowMissingOrigin, "allow-missing-origin", cfg.AllowMissingOrigin, "Let in non-browser clients sending no Origin when -allowed-origins is set")
+
+	fs.Float64Var(&cfg.RateLimitConnMessages, "rate-limit-conn-messages", cfg.RateLimitConnMessages, "The messages per second of a connection, unlimited if zero")
+	fs.Float64Var(&cfg.RateLimitConnBytes, "rate-limit-conn-bytes", cfg.RateLimitConnBytes, "The message bytes per second of a connection, unlimited if zero")
+	fs.Float64Var(&cfg.RateLimitIPMessages, "rate-limit-ip-messages", cfg.RateLimitIPMessages, "The messages per second of all the connections of an IP, unlimited if zero")
+	fs.Float64Var(&cfg.RateLimitIPBytes, "rate-limit-ip-bytes", cfg.RateLimitIPBytes, "The message bytes per second of all the connections of an IP, unlimited if zero")
+	fs.Float64Var(&cfg.RateLimitBurst, "rate-limit-burst", cfg.RateLimitBurst, "How many seconds worth of the rate limits may be sent at once, one if zero")
+	fs.StringVar(&cfg.RateLimitAction, "rate-limit-action", cfg.RateLimitAction, "What to do with the messages over the rate limits: delay, reject or close")
+
+	fs.StringVar(&cfg.SpoolDir, "spool-dir", cfg.SpoolDir, "The optional directory to spool messages to while Kafka is unavailable")
+	fs.Int64Var(&cfg.SpoolMaxBytes, "spool-max-bytes", cfg.SpoolMaxBytes, "The size limit of the spool, 1GB if zero")
+	fs.Int64Var(&cfg.SpoolSegmentBytes, "spool-segment-bytes", cfg.SpoolSegmentBytes, "The size of the spool files, 64MB if zero")
+	fs.StringVar(&cfg.SpoolSync, "spool-sync", cfg.SpoolSync, "When to flush the spool to disk: interval, always or never")
+	fs.Var(&cfg.SpoolSyncInterval, "spool-sync-interval", "The period of flushing the spool with -spool-sync=interval, a second if zero")
+	fs.Var(&cfg.SpoolRetryInterval, "spool-retry-interval", "The pause of the spool replay while Kafka is unavailable, a second if zero")
+}
+
+// loadConfig parses args and merges the result with the environment, the
+// config file and the defaults.
+func loadConfig(name string, args []string) (*config, error) {
+	cfg := defaultConfig()
+
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	file := fs.String("config", os.Getenv(envPrefix+"CONFIG"), "The optional JSON config file, also set by "+envPrefix+"CONFIG")
+	cfg.register(fs)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, usage, name)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected arguments %q", fs.Args())
+	}
+
+	// The flags are parsed first to find the config file, then they are
+	// applied again over the lower precedence sources.
+	explicit := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = f.Value.String()
+	})
+
+	cfg = defaultConfig()
+	if *file != "" {
+		if err := cfg.readFile(*file); err != nil {
+			return nil, err
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name == "config" || err != nil {
+			return
+		}
+		key, v, ok := lookupEnv(f.Name)
+		if !ok {
+			return
+		}
+		if serr := fs.Set(f.Name, v); serr != nil {
+			err = fmt.Errorf("invalid value %q for %s: %v", v, key, serr)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, key := range []string{envPrefix + "SASL_PASSWORD", "KAFKA_SASL_PASSWORD"} {
+		if v, ok := os.LookupEnv(key); ok {
+			cfg.SASLPassword = v
+			break
+		}
+	}
+
+	for name, v := range explicit {
+		if err := fs.Set(name, v); err != nil {
+			return nil, err
+		}
+	}
+	return &cfg, nil
+}
+
+// lookupEnv returns the environment variable of the flag name.
+func lookupEnv(name string) (key, value string, ok bool) {
+	key = envPrefix + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	if value, ok = os.LookupEnv(key); ok {
+		return key, value, true
+	}
+	if legacy, found := legacyEnv[name]; found {
+		value, ok = os.LookupEnv(legacy)
+		return legacy, value, ok
+	}
+	return "", "", false
+}
+
+// readFile merges the JSON config file into cfg. Unknown keys are errors,
+// so typos do not go unnoticed.
+func (cfg *config) readFile(name string) error {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".yaml", ".yml":
+		return errors.New("YAML config files are not supported, use JSON")
+	}
+
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return fmt.Errorf("%s: %v", name, err)
+	}
+	return nil
+}
+
+// validate checks the settings not checked by the Kawka options.
+func (cfg *config) validate() error {
+	if len(cfg.Brokers) == 0 {
+		return errors.New("no brokers, set -brokers or " + envPrefix + "BROKERS")
+	}
+	if cfg.Topic == "" {
+		return errors.New("no topic")
+	}
+	if _, ok := codecs[cfg.Compression]; !ok {
+		return errors.New("unknown compression codec " + cfg.Compression)
+	}
+	if (cfg.TLSCert == "") != (cfg.TLSKey == "") {
+		return errors.New("-tls-cert and -tls-key must be set together")
+	}
+	if (cfg.Certificate == "") != (cfg.Key == "") {
+		return errors.New("-certificate and -key must be set together")
+	}
+	return nil
+}
+
+// logger returns the logger configured by cfg.
+func (cfg *config) logger() (kawka.Logger, error) {
+	level, err := kawka.ParseLevel(cfg.LogLevel)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Verbose {
+		level = kawka.LevelDebug
+	}
+	return kawka.NewLogger(os.Stderr, level), nil
+}
+
+// options returns the Kawka options configured by cfg.
+func (cfg *config) options(logger kawka.Logger) ([]kawka.Option, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	partitioner, err := kawka.ParsePartitioner(cfg.Partitioner)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := cfg.Topic
+	partition := cfg.Partition
+	opts := []kawka.Option{
+		kawka.WithBrokers(cfg.Brokers),
+		kawka.WithLogger(logger),
+		kawka.WithAddr(cfg.Addr),
+		kawka.WithShutdownTimeout(time.Duration(cfg.ShutdownTimeout)),
+		kawka.WithMaxConnections(cfg.MaxConnections),
+		kawka.WithMaxConnectionsPerIP(cfg.MaxConnectionsPerIP),
+		kawka.WithHandshakeTimeout(time.Duration(cfg.HandshakeTimeout)),
+		kawka.WithMaxFrameSize(cfg.MaxFrameSize),
+		kawka.WithMaxMessageSize(cfg.MaxMessageSize),
+		kawka.WithKafkaVersion(cfg.KafkaVersion),
+		kawka.WithCompression(codecs[cfg.Compression]),
+		kawka.WithRequiredAcks(sarama.RequiredAcks(cfg.RequiredAcks)),
+		kawka.WithProducerTimeout(time.Duration(cfg.ProducerTimeout)),
+		kawka.WithRetries(cfg.Retries, time.Duration(cfg.RetryBackoff)),
+		kawka.WithMaxMessageBytes(cfg.MaxMessageBytes),
+		kawka.WithFlushFrequency(time.Duration(cfg.FlushFrequency)),
+		kawka.WithPartitioner(partitioner),
+		kawka.WithRecordHandler(func(peer *kawka.Peer, data []byte) ([]*kawka.Record, error) {
+			rec := &kawka.Record{Topic: topic, Value: data}
+			if partition >= 0 {
+				p := int32(partition)
+				rec.Partition = &p
+			}
+			return []*kawka.Record{rec}, nil
+		}),
+	}
+
+	if cfg.KafkaTLS || cfg.Certificate != "" || cfg.CA != "" {
+		opts = append(opts, kawka.WithKafkaTLS(kawka.KafkaTLS{
+			CAFile:             cfg.CA,
+			CertFile:           cfg.Certificate,
+			KeyFile:            cfg.Key,
+			ServerName:         cfg.KafkaServerName,
+			InsecureSkipVerify: !cfg.Verify,
+		}))
+	}
+	if cfg.SASLUser != "" {
+		password := cfg.SASLPassword
+		if cfg.SASLPasswordFile != "" {
+			data, err := ioutil.ReadFile(cfg.SASLPasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		opts = append(opts, kawka.WithSASLPlain(cfg.SASLUser, password))
+	}
+	if cfg.TLSCert != "" {
+		opts = append(opts, kawka.WithTSL(cfg.TLSCert, cfg.TLSKey))
+	}
+	if cfg.TLSClientCA != "" {
+		opts = append(opts, kawka.WithClientCA(cfg.TLSClientCA))
+	}
+	if cfg.Deflate {
+		opts = append(opts, kawka.WithDeflate(kawka.DeflateConfig{
+			Level:                   cfg.DeflateLevel,
+			ServerMaxWindowBits:     cfg.DeflateServerMaxWindowBits,
+			ClientMaxWindowBits:     cfg.DeflateClientMaxWindowBits,
+			ServerNoContextTakeover: cfg.DeflateServerNoContextTakeover,
+			ClientNoContextTakeover: cfg.DeflateClientNoContextTakeover,
+		}))
+	}
+	if cfg.JWTHMACKeyFile != "" || cfg.JWTRSAKeyFile != "" {
+		opts = append(opts, kawka.WithJWT(kawka.JWTConfig{
+			HMACKeyFile: cfg.JWTHMACKeyFile,
+			RSAKeyFile:  cfg.JWTRSAKeyFile,
+			QueryParam:  cfg.JWTQueryParam,
+			Issuer:      cfg.JWTIssuer,
+			Audience:    cfg.JWTAudience,
+			Leeway:      time.Duration(cfg.JWTLeeway),
+		}))
+	}
+	if len(cfg.AllowedOrigins) > 0 {
+		opts = append(opts, kawka.WithOrigins(kawka.OriginConfig{
+			Allowed:      cfg.AllowedOrigins,
+			AllowMissing: cfg.AllowMissingOrigin,
+		}))
+	}
+	if cfg.RateLimitConnMessages > 0 || cfg.RateLimitConnBytes > 0 || cfg.RateLimitIPMessages > 0 || cfg.RateLimitIPBytes > 0 {
+		action, err := kawka.ParseRateAction(cfg.RateLimitAction)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kawka.WithRateLimit(kawka.RateLimitConfig{
+			Conn:   kawka.RateLimit{Messages: cfg.RateLimitConnMessages, Bytes: cfg.RateLimitConnBytes, Burst: cfg.RateLimitBurst},
+			IP:     kawka.RateLimit{Messages: cfg.RateLimitIPMessages, Bytes: cfg.RateLimitIPBytes, Burst: cfg.RateLimitBurst},
+			Action: action,
+		}))
+	}
+	if cfg.PolicyFile != "" {
+		opts = append(opts, kawka.WithPolicy(cfg.PolicyFile))
+	}
+	if cfg.Acks {
+		opts = append(opts, kawka.WithAcks())
+	}
+	if cfg.Subscriptions {
+		opts = append(opts, kawka.WithSubscriptions())
+	}
+	if cfg.Async > 0 {
+		opts = append(opts, kawka.WithAsyncProducer(cfg.Async))
+	}
+	if cfg.DeadLetterTopic != "" {
+		opts = append(opts, kawka.WithDeadLetterTopic(cfg.DeadLetterTopic))
+	}
+	if cfg.MetricsAddr != "" {
+		opts = append(opts, kawka.WithMetricsAddr(cfg.MetricsAddr))
+	}
+	if cfg.SpoolDir != "" {
+		policy, err := kawka.ParseSyncPolicy(cfg.SpoolSync)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, kawka.WithSpool(kawka.SpoolConfig{
+			Dir:           cfg.SpoolDir,
+			MaxBytes:      cfg.SpoolMaxBytes,
+			SegmentBytes:  cfg.SpoolSegmentBytes,
+			Sync:          policy,
+			SyncInterval:  time.Duration(cfg.SpoolSyncInterval),
+			RetryInterval: time.Duration(cfg.SpoolRetryInterval),
+		}))
+	}
+	return opts, nil
+}
+
+// list is a comma separated flag, a JSON array in the config file.
+type list []string
+
+func (l *list) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *list) Set(s string) error {
+	*l = nil
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			*l = append(*l, v)
+		}
+	}
+	return nil
+}
+
+// duration is a time.Duration flag, a string like "10s" in the config
+// file.
+type duration time.Duration
+
+func (d *duration) String() string {
+	return time.Duration(*d).String()
+}
+
+func (d *duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d *duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	return d.Set(s)
+}
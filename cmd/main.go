@@ -1,46 +1,106 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"os"
-	"strings"
+	"os/signal"
+	"syscall"
 
+	"github.com/Shopify/sarama"
 	"github.com/cristaloleg/kawka"
 )
 
-var (
-	addr      = flag.String("addr", ":8080", "The address to bind to")
-	brokers   = flag.String("brokers", os.Getenv("KAFKA_PEERS"), "The Kafka brokers to connect to, as a comma separated list")
-	verbose   = flag.Bool("verbose", false, "Turn on Sarama logging")
-	topic     = flag.String("topic", "test", "topic name")
-	partition = flag.Int64("partition", 0, "partition")
-	// certFile  = flag.String("certificate", "", "The optional certificate file for client authentication")
-	// keyFile   = flag.String("key", "", "The optional key file for client authentication")
-	// caFile    = flag.String("ca", "", "The optional certificate authority file for TLS client authentication")
-	// verifySsl = flag.Bool("verify", false, "Optional verify ssl certificates chain")
-)
+const usage = `Usage:
+  %[1]s [flags]           serve WebSocket clients
+  %[1]s validate [flags]  check the config and the brokers without serving
+
+Every flag can also be set by the KAWKA_ environment variable named after it,
+like KAWKA_DEAD_LETTER_TOPIC for -dead-letter-topic, or by the JSON config
+file key with underscores, like "dead_letter_topic". Flags take precedence
+over the environment, which takes precedence over the config file.
+
+Flags:
+`
+
+func main() {
+	name, args := os.Args[0], os.Args[1:]
+
+	run := serve
+	if len(args) > 0 && args[0] == "validate" {
+		run, args = validate, args[1:]
+	}
 
-func init() {
-	flag.Parse()
+	cfg, err := loadConfig(name, args)
+	if err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		}
+		os.Exit(2)
+	}
 
-	if *brokers == "" {
-		flag.PrintDefaults()
+	if err := run(cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
 		os.Exit(1)
 	}
 }
 
-func main() {
-	brokerList := strings.Split(*brokers, ",")
-	if len(brokerList) == 0 {
-		panic("brokers are unavailable")
-	}
-
-	kawka := kawka.New(
-		kawka.WithBrokers(brokerList),
-		kawka.WithPort(5986),
-		kawka.WithHandler(func(data []byte) (string, []byte, error) {
-			return *topic, data, nil
-		}),
-	)
-	_ = kawka.Start()
+// setup returns the Kawka options and the logger configured by cfg.
+func setup(cfg *config) ([]kawka.Option, kawka.Logger, error) {
+	logger, err := cfg.logger()
+	if err != nil {
+		return nil, nil, err
+	}
+	if cfg.Verbose {
+		sarama.Logger = kawka.SaramaLogger(logger)
+	}
+
+	opts, err := cfg.options(logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	return opts, logger, nil
+}
+
+func serve(cfg *config) error {
+	opts, _, err := setup(cfg)
+	if err != nil {
+		return err
+	}
+
+	wk, err := kawka.Open(opts...)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	if err := wk.Start(ctx); err != nil && err != context.Canceled {
+		return err
+	}
+	return nil
+}
+
+// validate checks the config and connects to the brokers. Unlike serve
+// it leaves the spool of a running instance alone.
+func validate(cfg *config) error {
+	opts, logger, err := setup(cfg)
+	if err != nil {
+		return err
+	}
+
+	if err := kawka.Check(opts...); err != nil {
+		return err
+	}
+	logger.Info("config is valid, brokers are reachable", "brokers", cfg.Brokers.String())
+	return nil
 }
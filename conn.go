@@ -0,0 +1,366 @@
+package kawka
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	kafka "github.com/Shopify/sarama"
+	websocket "github.com/gobwas/ws"
+)
+
+// errConnClosing is returned on writes to a connection being closed.
+var errConnClosing = errors.New("kawka: connection is closing")
+
+const (
+	// closeTimeout bounds the time spent on writing a close frame to a client.
+	closeTimeout = time.Second
+
+	// writeTimeout bounds the time spent on writing a frame to a client.
+	// The connection is closed if the client does not read it in time.
+	writeTimeout = 10 * time.Second
+)
+
+// Peer describes a client connected to Kawka.
+type Peer struct {
+	// ID identifies the connection, it is unique per Kawka instance.
+	ID uint64
+
+	// RemoteAddr is the network address of the client.
+	RemoteAddr net.Addr
+
+	// Subject is the subject of the verified TLS client certificate.
+	// It is empty when client certificates are not required.
+	Subject string
+
+	// Claims are the claims verified by the Authenticator.
+	// They are nil when no Authenticator is set.
+	Claims Claims
+}
+
+// conn is a single client connection served by Kawka.
+type conn struct {
+	net.Conn
+	peer Peer
+
+	// r reads the client frames. It differs from Conn when the
+	// connection was hijacked with some data already buffered.
+	r io.Reader
+
+	// deflate is set when permessage-deflate was negotiated.
+	deflate *deflater
+
+	// pipe is set when records are produced asynchronously.
+	pipe *pipeline
+
+	// limits are the rate limits of the connection and of its IP.
+	limits []*limiter
+	ip     string
+
+	// quit is closed when the connection starts draining or closing.
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	// upgraded and draining are accessed atomically, so draining never
+	// waits for a write in progress.
+	upgraded int32
+	draining int32
+
+	// maxFrame and maxMessage limit the size of the client frames and
+	// messages, zero is unlimited.
+	maxFrame   int64
+	maxMessage int64
+
+	metrics *kawkaMetrics
+
+	mu      sync.Mutex // guards writes to the Conn and closing
+	closing bool
+
+	// consumer consumes the subscriptions of the connection. Every
+	// connection has its own, as a consumer reads a partition only once.
+	subsMu   sync.Mutex
+	consumer kafka.Consumer
+	subs     map[subscription]kafka.PartitionConsumer
+}
+
+func (wk *Kawka) newConn(nc net.Conn) *conn {
+	c := &conn{
+		Conn:       nc,
+		r:          nc,
+		metrics:    wk.metrics,
+		quit:       make(chan struct{}),
+		maxFrame:   wk.maxFrameSize,
+		maxMessage: wk.maxMessageSize,
+		peer: Peer{
+			ID:         atomic.AddUint64(&wk.lastID, 1),
+			RemoteAddr: nc.RemoteAddr(),
+		},
+	}
+	if wk.maxInFlight > 0 {
+		c.pipe = newPipeline(wk.maxInFlight)
+	}
+	return c
+}
+
+// setTLSState fills the peer identity from the state of a completed
+// TLS handshake.
+func (c *conn) setTLSState(state *tls.ConnectionState) {
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return
+	}
+	c.peer.Subject = state.VerifiedChains[0][0].Subject.String()
+}
+
+// setUpgraded marks c as a WebSocket connection.
+// It returns false if c was shut down during the handshake.
+func (c *conn) setUpgraded() bool {
+	// Pairs with drain: either drain sees the connection upgraded, or
+	// the connection sees it draining.
+	atomic.StoreInt32(&c.upgraded, 1)
+	if c.isDraining() {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.closing
+}
+
+// writeFrame writes f to the client. It is safe for concurrent use.
+// No frames are written after the closing handshake has started.
+func (c *conn) writeFrame(f websocket.Frame) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return errConnClosing
+	}
+	return c.write(f)
+}
+
+// writeMessage writes a data message to the client, compressing it when
+// permessage-deflate was negotiated. It is safe for concurrent use.
+func (c *conn) writeMessage(op websocket.OpCode, p []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return errConnClosing
+	}
+
+	f := websocket.NewFrame(op, true, p)
+	if c.deflate != nil {
+		compressed, err := c.deflate.compress(p)
+		if err != nil {
+			return err
+		}
+		f = websocket.NewFrame(op, true, compressed)
+		f.Header.Rsv = websocket.Rsv(true, false, false)
+	}
+	return c.write(f)
+}
+
+// write writes f within writeTimeout. A frame written partially leaves
+// the stream corrupted, so the connection is closed on errors.
+// c.mu must be held.
+func (c *conn) write(f websocket.Frame) error {
+	c.Conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := websocket.WriteFrame(c.Conn, f); err != nil {
+		c.closing = true
+		c.closeQuit()
+		c.Conn.Close()
+		return err
+	}
+	return nil
+}
+
+func (c *conn) closeQuit() {
+	c.quitOnce.Do(func() { close(c.quit) })
+}
+
+// drain unblocks the read loop, so the connection is closed with
+// StatusGoingAway as soon as a message being processed is done.
+// Connections that are not upgraded yet are just closed.
+//
+// It never waits for the writes to the connection, so a client not
+// reading its replies does not hold up Shutdown.
+func (c *conn) drain() {
+	if !atomic.CompareAndSwapInt32(&c.draining, 0, 1) {
+		return
+	}
+	c.closeQuit()
+
+	if atomic.LoadInt32(&c.upgraded) == 0 {
+		c.Conn.Close()
+		return
+	}
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+func (c *conn) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// shutdown starts the closing handshake with the client and unblocks the
+// read loop. Connections that are not upgraded yet are just closed.
+func (c *conn) shutdown(code websocket.StatusCode, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closing {
+		return
+	}
+	c.closing = true
+	c.closeQuit()
+
+	if atomic.LoadInt32(&c.upgraded) == 0 {
+		c.Conn.Close()
+		return
+	}
+
+	c.Conn.SetWriteDeadline(time.Now().Add(closeTimeout))
+	if err := websocket.WriteFrame(c.Conn, websocket.NewCloseFrame(code, reason)); err != nil {
+		c.Conn.Close()
+		return
+	}
+	c.Conn.SetReadDeadline(time.Now())
+}
+
+func (wk *Kawka) serveConn(c *conn) {
+	defer c.Close()
+	defer c.unsubscribeAll()
+	defer c.wait()
+
+	if !c.setUpgraded() {
+		return
+	}
+	if c.pipe != nil {
+		go wk.replyAsync(c)
+		defer c.pipe.close()
+	}
+	wk.logger.Debug("connection opened", c.peer.keyvals()...)
+	defer wk.logger.Debug("connection closed", c.peer.keyvals()...)
+
+	for {
+		_, payload, err := c.readMessage()
+		if err != nil {
+			if ce, ok := err.(closeError); ok {
+				c.shutdown(ce.code, ce.reason)
+			} else if c.isDraining() {
+				c.wait()
+				c.shutdown(websocket.StatusGoingAway, "server is shutting down")
+			}
+			return
+		}
+
+		allowed, err := wk.throttle(c, len(payload))
+		if ce, ok := err.(closeError); ok {
+			c.shutdown(ce.code, ce.reason)
+			return
+		}
+		if !allowed {
+			wk.replyRejected(c, "", payload, "", CodeRateLimited, errRateLimited)
+			continue
+		}
+
+		if wk.subscriptions {
+			if cmd, ok := parseCommand(payload); ok {
+				wk.handleCommand(c, cmd)
+				continue
+			}
+		}
+
+		records, err := wk.handler(&c.peer, payload)
+		if err != nil {
+			wk.logger.Warn("error in handler", c.peer.keyvals("err", err)...)
+			wk.metrics.handlerErrors.Inc(1)
+			wk.replyError(c, messageID(payload), "", CodeBadMessage, err)
+			wk.deadLetter(&c.peer, payload, "", err)
+			continue
+		}
+
+		var id string
+		if wk.acks {
+			id = messageID(payload)
+		}
+		for _, rec := range records {
+			if rec.ID == "" {
+				rec.ID = id
+			}
+			wk.produce(c, &envelope{peer: &c.peer, rec: rec, payload: payload})
+		}
+	}
+}
+
+// produce sends the record of env to Kafka and replies to the client with
+// the result. In the async mode the reply is sent when the producer reports
+// back.
+func (wk *Kawka) produce(c *conn, env *envelope) {
+	rec := env.rec
+	if len(rec.Headers) > 0 && !wk.headersSupported() {
+		wk.logger.Warn("error in handler", c.peer.keyvals("topic", rec.Topic, "err", errHeadersUnsupported)...)
+		wk.metrics.handlerErrors.Inc(1)
+		wk.replyError(c, rec.ID, rec.Topic, CodeBadMessage, errHeadersUnsupported)
+		return
+	}
+
+	access := Access{Op: OpProduce, Topic: rec.Topic}
+	if wk.policy != nil || wk.authorizer != nil {
+		access.Type = messageType(env.payload)
+	}
+	if err := wk.authorize(&c.peer, access); err != nil {
+		wk.logger.Warn("access denied", c.peer.keyvals("topic", rec.Topic, "err", err)...)
+		wk.replyRejected(c, rec.ID, env.payload, rec.Topic, CodeForbidden, err)
+		wk.deadLetter(&c.peer, env.payload, rec.Topic, err)
+		return
+	}
+
+	// The records spooled while Kafka was unavailable go first.
+	if wk.spoolBehind(env) {
+		if c.pipe != nil {
+			c.pipe.done(c.pipe.add(), result{env: env, err: errSpooled})
+			return
+		}
+		wk.complete(c, env, -1, -1, errSpooled)
+		return
+	}
+
+	if c.pipe != nil {
+		wk.produceAsync(c, env)
+		return
+	}
+
+	partition, offset, err := wk.sendMessage(env)
+	wk.complete(c, env, partition, offset, err)
+}
+
+// complete replies to the client with the result of producing the record
+// of env.
+func (wk *Kawka) complete(c *conn, env *envelope, partition int32, offset int64, err error) {
+	rec := env.rec
+	if err == nil {
+		wk.metrics.produced(rec.Topic, env.start, nil)
+		wk.replyAck(c, rec.ID, rec.Topic, partition, offset)
+		return
+	}
+	if err == errSpooled || wk.spoolRecord(env, err) {
+		wk.replySpooled(c, rec.ID, rec.Topic)
+		return
+	}
+
+	wk.logger.Error("error on produce", env.peer.keyvals("topic", rec.Topic, "err", err)...)
+	wk.metrics.produced(rec.Topic, env.start, err)
+	wk.replyError(c, rec.ID, rec.Topic, CodeProduceFailed, err)
+	wk.deadLetter(env.peer, env.payload, rec.Topic, err)
+}
+
+// wait blocks until all the records of c produced asynchronously are done.
+func (c *conn) wait() {
+	if c.pipe != nil {
+		c.pipe.wait()
+	}
+}
@@ -0,0 +1,63 @@
+package kawka
+
+import (
+	"strconv"
+	"time"
+
+	kafka "github.com/Shopify/sarama"
+)
+
+// Headers of the dead-letter records.
+const (
+	// HeaderError is the reason the message was not produced.
+	HeaderError = "kawka-error"
+
+	// HeaderTopic is the topic the message was meant for, if known.
+	HeaderTopic = "kawka-topic"
+
+	// HeaderConnID is the ID of the connection the message came from.
+	HeaderConnID = "kawka-conn-id"
+
+	// HeaderRemoteAddr is the address of the client.
+	HeaderRemoteAddr = "kawka-remote-addr"
+
+	// HeaderTimestamp is the time of the failure in RFC 3339 format.
+	HeaderTimestamp = "kawka-timestamp"
+)
+
+// deadLetter produces the raw client payload to the dead-letter topic,
+// if any, describing why it was not produced to topic.
+func (wk *Kawka) deadLetter(peer *Peer, payload []byte, topic string, reason error) {
+	if wk.deadLetterTopic == "" {
+		return
+	}
+
+	headers := append(peerHeaders(peer),
+		kafka.RecordHeader{Key: []byte(HeaderError), Value: []byte(reason.Error())},
+		kafka.RecordHeader{Key: []byte(HeaderConnID), Value: []byte(strconv.FormatUint(peer.ID, 10))},
+		kafka.RecordHeader{Key: []byte(HeaderTimestamp), Value: []byte(time.Now().UTC().Format(time.RFC3339Nano))},
+	)
+	if topic != "" {
+		headers = append(headers, kafka.RecordHeader{Key: []byte(HeaderTopic), Value: []byte(topic)})
+	}
+	if peer.RemoteAddr != nil {
+		headers = append(headers, kafka.RecordHeader{Key: []byte(HeaderRemoteAddr), Value: []byte(peer.RemoteAddr.String())})
+	}
+
+	wk.metrics.deadLetters.Inc(1)
+
+	msg := &kafka.ProducerMessage{
+		Topic:    wk.deadLetterTopic,
+		Value:    kafka.ByteEncoder(payload),
+		Headers:  headers,
+		Metadata: &envelope{peer: peer},
+	}
+
+	// The message is sent aside, so the caller is not blocked by the
+	// producer, and its errors are logged by dispatch.
+	wk.deadLetters.Add(1)
+	go func() {
+		defer wk.deadLetters.Done()
+		wk.producer.Input() <- msg
+	}()
+}
@@ -0,0 +1,280 @@
+package kawka
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/gobwas/httphead"
+)
+
+// deflateExtension is the name of the permessage-deflate extension.
+const deflateExtension = "permessage-deflate"
+
+// Extension parameters defined by RFC 7692.
+const (
+	serverNoContextTakeover = "server_no_context_takeover"
+	clientNoContextTakeover = "client_no_context_takeover"
+	serverMaxWindowBits     = "server_max_window_bits"
+	clientMaxWindowBits     = "client_max_window_bits"
+)
+
+const (
+	minWindowBits = 8
+	maxWindowBits = 15
+)
+
+// deflateTail is removed from the end of each compressed message, see
+// RFC 7692 section 7.2.1.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff}
+
+// deflateFinal terminates a compressed message before inflating it: the
+// removed tail and an empty final block, so the reader ends with io.EOF.
+var deflateFinal = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// DeflateConfig configures the permessage-deflate extension (RFC 7692).
+type DeflateConfig struct {
+	// Level is the compression level of the messages sent by Kawka,
+	// as defined in compress/flate. Zero means flate.DefaultCompression.
+	Level int
+
+	// ServerMaxWindowBits limits the LZ77 window of the messages sent by
+	// Kawka, from 8 to 15. Zero means 15.
+	//
+	// compress/flate always uses a 32KB window, so with smaller windows
+	// the messages are compressed with Huffman coding only.
+	ServerMaxWindowBits int
+
+	// ClientMaxWindowBits limits the LZ77 window of the messages sent by
+	// clients, from 8 to 15. Zero means 15. Offers of clients unable to
+	// limit their window are declined.
+	ClientMaxWindowBits int
+
+	// ServerNoContextTakeover makes Kawka reset its compressor after each
+	// message, trading compression ratio for memory.
+	ServerNoContextTakeover bool
+
+	// ClientNoContextTakeover asks clients to reset their compressor after
+	// each message.
+	ClientNoContextTakeover bool
+}
+
+func (cfg *DeflateConfig) validate() error {
+	if cfg.Level < flate.HuffmanOnly || cfg.Level > flate.BestCompression {
+		return errors.New("kawka: invalid deflate level " + strconv.Itoa(cfg.Level))
+	}
+	if cfg.Level == 0 {
+		cfg.Level = flate.DefaultCompression
+	}
+	for _, bits := range []*int{&cfg.ServerMaxWindowBits, &cfg.ClientMaxWindowBits} {
+		if *bits == 0 {
+			*bits = maxWindowBits
+		}
+		if *bits < minWindowBits || *bits > maxWindowBits {
+			return errors.New("kawka: invalid deflate window bits " + strconv.Itoa(*bits))
+		}
+	}
+	return nil
+}
+
+// deflateParams are the extension parameters agreed with a client.
+type deflateParams struct {
+	serverWindowBits  int
+	clientWindowBits  int
+	serverNoTakeover  bool
+	clientNoTakeover  bool
+	clientBitsOffered bool
+}
+
+// negotiate selects the first acceptable permessage-deflate offer from the
+// Sec-WebSocket-Extensions header value. It returns the agreed parameters
+// and the option to be sent back to the client.
+func (cfg *DeflateConfig) negotiate(header []byte) (deflateParams, httphead.Option, bool) {
+	offers, ok := httphead.ParseOptions(header, nil)
+	if !ok {
+		return deflateParams{}, httphead.Option{}, false
+	}
+	for _, offer := range offers {
+		if string(offer.Name) != deflateExtension {
+			continue
+		}
+		params, ok := cfg.accept(offer)
+		if !ok {
+			continue
+		}
+		return params, params.option(), true
+	}
+	return deflateParams{}, httphead.Option{}, false
+}
+
+// accept checks a single offer against cfg.
+func (cfg *DeflateConfig) accept(offer httphead.Option) (deflateParams, bool) {
+	params := deflateParams{
+		serverWindowBits: cfg.ServerMaxWindowBits,
+		clientWindowBits: maxWindowBits,
+		serverNoTakeover: cfg.ServerNoContextTakeover,
+		clientNoTakeover: cfg.ClientNoContextTakeover,
+	}
+
+	seen := make(map[string]bool)
+	ok := true
+	offer.Parameters.ForEach(func(k, v []byte) bool {
+		key := string(k)
+		if seen[key] {
+			ok = false
+			return false
+		}
+		seen[key] = true
+
+		switch key {
+		case serverNoContextTakeover:
+			ok = len(v) == 0
+			params.serverNoTakeover = true
+
+		case clientNoContextTakeover:
+			ok = len(v) == 0
+			params.clientNoTakeover = true
+
+		case serverMaxWindowBits:
+			var bits int
+			bits, ok = parseWindowBits(v)
+			if bits < params.serverWindowBits {
+				params.serverWindowBits = bits
+			}
+
+		case clientMaxWindowBits:
+			params.clientBitsOffered = true
+			if len(v) != 0 {
+				var bits int
+				bits, ok = parseWindowBits(v)
+				params.clientWindowBits = bits
+			}
+
+		default:
+			ok = false
+		}
+		return ok
+	})
+	if !ok {
+		return deflateParams{}, false
+	}
+
+	if cfg.ClientMaxWindowBits < params.clientWindowBits {
+		if !params.clientBitsOffered {
+			return deflateParams{}, false
+		}
+		params.clientWindowBits = cfg.ClientMaxWindowBits
+	}
+	return params, true
+}
+
+func parseWindowBits(v []byte) (int, bool) {
+	bits, err := strconv.Atoi(string(v))
+	if err != nil || bits < minWindowBits || bits > maxWindowBits {
+		return 0, false
+	}
+	return bits, true
+}
+
+// option returns the extension negotiation response for p.
+func (p deflateParams) option() httphead.Option {
+	opt := httphead.Option{Name: []byte(deflateExtension)}
+	if p.serverNoTakeover {
+		opt.Parameters.Set([]byte(serverNoContextTakeover), nil)
+	}
+	if p.clientNoTakeover {
+		opt.Parameters.Set([]byte(clientNoContextTakeover), nil)
+	}
+	if p.serverWindowBits < maxWindowBits {
+		opt.Parameters.Set([]byte(serverMaxWindowBits), []byte(strconv.Itoa(p.serverWindowBits)))
+	}
+	if p.clientBitsOffered && p.clientWindowBits < maxWindowBits {
+		opt.Parameters.Set([]byte(clientMaxWindowBits), []byte(strconv.Itoa(p.clientWindowBits)))
+	}
+	return opt
+}
+
+// headerValue renders opt as a Sec-WebSocket-Extensions header value.
+func headerValue(opt httphead.Option) string {
+	var buf bytes.Buffer
+	httphead.WriteOptions(&buf, []httphead.Option{opt})
+	return buf.String()
+}
+
+// deflater compresses and decompresses the messages of one connection.
+type deflater struct {
+	params deflateParams
+	level  int
+
+	w   *flate.Writer
+	out bytes.Buffer
+
+	// dict holds the tail of the previous inbound messages when the client
+	// uses context takeover.
+	dict []byte
+}
+
+func newDeflater(params deflateParams, level int) *deflater {
+	if params.serverWindowBits < maxWindowBits {
+		level = flate.HuffmanOnly
+	}
+	return &deflater{
+		params: params,
+		level:  level,
+	}
+}
+
+// compress returns the compressed form of p. The result is valid until the
+// next call of compress.
+func (d *deflater) compress(p []byte) ([]byte, error) {
+	d.out.Reset()
+	if d.w == nil {
+		w, err := flate.NewWriter(&d.out, d.level)
+		if err != nil {
+			return nil, err
+		}
+		d.w = w
+	} else if d.params.serverNoTakeover {
+		d.w.Reset(&d.out)
+	}
+
+	if _, err := d.w.Write(p); err != nil {
+		return nil, err
+	}
+	if err := d.w.Flush(); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(d.out.Bytes(), deflateTail), nil
+}
+
+// decompress returns the inflated form of the compressed message p.
+// It returns errMessageTooBig if the message inflates to more than limit
+// bytes, unless limit is zero.
+func (d *deflater) decompress(p []byte, limit int64) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(p), bytes.NewReader(deflateFinal))
+	fr := flate.NewReaderDict(src, d.dict)
+	defer fr.Close()
+
+	var r io.Reader = fr
+	if limit > 0 {
+		r = io.LimitReader(fr, limit+1)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && int64(len(data)) > limit {
+		return nil, errMessageTooBig
+	}
+
+	if !d.params.clientNoTakeover {
+		d.dict = append(d.dict, data...)
+		if window := 1 << uint(d.params.clientWindowBits); len(d.dict) > window {
+			d.dict = append(d.dict[:0], d.dict[len(d.dict)-window:]...)
+		}
+	}
+	return data, nil
+}
@@ -0,0 +1,229 @@
+package kawka
+
+import (
+	"bytes"
+	"compress/flate"
+	"strings"
+	"testing"
+
+	websocket "github.com/gobwas/ws"
+)
+
+func TestDeflateNegotiate(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		cfg    DeflateConfig
+		header string
+		want   string // response, empty if declined
+	}{
+		{
+			name:   "default",
+			header: "permessage-deflate",
+			want:   "permessage-deflate",
+		},
+		{
+			name:   "other extension",
+			header: "x-webkit-deflate-frame",
+		},
+		{
+			name:   "malformed",
+			header: "permessage-deflate; =",
+		},
+		{
+			name:   "server no context takeover",
+			header: "permessage-deflate; server_no_context_takeover",
+			want:   "permessage-deflate;server_no_context_takeover",
+		},
+		{
+			name:   "server no context takeover with value",
+			header: "permessage-deflate; server_no_context_takeover=1",
+		},
+		{
+			name:   "client no context takeover required",
+			cfg:    DeflateConfig{ClientNoContextTakeover: true},
+			header: "permessage-deflate",
+			want:   "permessage-deflate;client_no_context_takeover",
+		},
+		{
+			name:   "server window",
+			header: "permessage-deflate; server_max_window_bits=10",
+			want:   "permessage-deflate;server_max_window_bits=10",
+		},
+		{
+			name:   "server window limited by config",
+			cfg:    DeflateConfig{ServerMaxWindowBits: 9},
+			header: "permessage-deflate; server_max_window_bits=12",
+			want:   "permessage-deflate;server_max_window_bits=9",
+		},
+		{
+			name:   "server window out of range",
+			header: "permessage-deflate; server_max_window_bits=7",
+		},
+		{
+			name:   "client window offered",
+			header: "permessage-deflate; client_max_window_bits",
+			want:   "permessage-deflate",
+		},
+		{
+			name:   "client window limited by config",
+			cfg:    DeflateConfig{ClientMaxWindowBits: 10},
+			header: "permessage-deflate; client_max_window_bits=12",
+			want:   "permessage-deflate;client_max_window_bits=10",
+		},
+		{
+			name:   "client window not offered",
+			cfg:    DeflateConfig{ClientMaxWindowBits: 10},
+			header: "permessage-deflate",
+		},
+		{
+			name:   "client window within config",
+			cfg:    DeflateConfig{ClientMaxWindowBits: 10},
+			header: "permessage-deflate; client_max_window_bits=9",
+			want:   "permessage-deflate;client_max_window_bits=9",
+		},
+		{
+			name:   "duplicate parameter",
+			header: "permessage-deflate; server_no_context_takeover; server_no_context_takeover",
+		},
+		{
+			name:   "unknown parameter",
+			header: "permessage-deflate; foo",
+		},
+		{
+			name:   "fallback offer",
+			header: "permessage-deflate; foo, permessage-deflate; server_max_window_bits=12",
+			want:   "permessage-deflate;server_max_window_bits=12",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			cfg := test.cfg
+			if err := cfg.validate(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, opt, ok := cfg.negotiate([]byte(test.header))
+			if test.want == "" {
+				if ok {
+					t.Errorf("got %q, want the offer declined", headerValue(opt))
+				}
+				return
+			}
+			if !ok {
+				t.Fatalf("got the offer declined, want %q", test.want)
+			}
+			if got := strings.Replace(headerValue(opt), " ", "", -1); got != test.want {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDeflateContextTakeover(t *testing.T) {
+	msg := []byte(strings.Repeat(`{"type":"click","page":"/index.html"}`, 4))
+
+	for _, noTakeover := range []bool{false, true} {
+		// The client compresses with a deflater of the same parameters.
+		server := newDeflater(deflateParams{
+			serverWindowBits: maxWindowBits,
+			clientWindowBits: maxWindowBits,
+			serverNoTakeover: noTakeover,
+			clientNoTakeover: noTakeover,
+		}, flate.BestCompression)
+		client := newDeflater(server.params, flate.BestCompression)
+
+		var sizes []int
+		for i := 0; i < 3; i++ {
+			p, err := client.compress(msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sizes = append(sizes, len(p))
+
+			data, err := server.decompress(p, 0)
+			if err != nil {
+				t.Fatalf("no takeover %v, message %d: %v", noTakeover, i, err)
+			}
+			if !bytes.Equal(data, msg) {
+				t.Fatalf("no takeover %v, message %d: got %q", noTakeover, i, data)
+			}
+		}
+
+		switch {
+		case noTakeover && (sizes[1] != sizes[0] || len(server.dict) != 0):
+			t.Errorf("messages are compressed with the context: sizes %v, dict %d", sizes, len(server.dict))
+		case !noTakeover && sizes[1] >= sizes[0]:
+			t.Errorf("messages are compressed without the context: sizes %v", sizes)
+		}
+	}
+}
+
+func TestDeflateWindow(t *testing.T) {
+	d := newDeflater(deflateParams{clientWindowBits: minWindowBits}, 0)
+	client := newDeflater(deflateParams{serverWindowBits: maxWindowBits}, flate.HuffmanOnly)
+
+	msg := bytes.Repeat([]byte("0123456789"), 100)
+	p, err := client.compress(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.decompress(p, 0); err != nil {
+		t.Fatal(err)
+	}
+	if len(d.dict) != 1<<minWindowBits {
+		t.Errorf("got a dictionary of %d bytes, want %d", len(d.dict), 1<<minWindowBits)
+	}
+	if !bytes.Equal(d.dict, msg[len(msg)-len(d.dict):]) {
+		t.Errorf("the dictionary is not the tail of the message")
+	}
+
+	// HuffmanOnly is forced for the windows smaller than compress/flate
+	// uses, so the messages never refer past the window.
+	if small := newDeflater(deflateParams{serverWindowBits: 10}, flate.BestCompression); small.level != flate.HuffmanOnly {
+		t.Errorf("got level %d for a small window, want HuffmanOnly", small.level)
+	}
+}
+
+func TestDeflateLimit(t *testing.T) {
+	client := newDeflater(deflateParams{serverWindowBits: maxWindowBits, serverNoTakeover: true}, flate.BestCompression)
+	p, err := client.compress(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := newDeflater(deflateParams{clientWindowBits: maxWindowBits, clientNoTakeover: true}, 0)
+	if _, err := d.decompress(p, 1<<10); err != errMessageTooBig {
+		t.Errorf("got %v, want errMessageTooBig", err)
+	}
+	if data, err := d.decompress(p, 1<<20); err != nil || len(data) != 1<<20 {
+		t.Errorf("got %d bytes, %v, want the message within the limit", len(data), err)
+	}
+}
+
+func TestReadMessageCompressed(t *testing.T) {
+	params := deflateParams{serverWindowBits: maxWindowBits, clientWindowBits: maxWindowBits}
+	client := newDeflater(params, flate.BestCompression)
+
+	var frames []websocket.Frame
+	for _, msg := range []string{"hello", "hello"} {
+		p, err := client.compress([]byte(msg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The compressed message is split, only its first frame has rsv1.
+		first := websocket.NewFrame(websocket.OpText, false, append([]byte(nil), p[:1]...))
+		first.Header.Rsv = websocket.Rsv(true, false, false)
+		frames = append(frames, first, websocket.NewFrame(websocket.OpContinuation, true, append([]byte(nil), p[1:]...)))
+	}
+
+	c, _ := newTestConn(t, frames...)
+	c.deflate = newDeflater(params, 0)
+	for i := 0; i < 2; i++ {
+		_, p, err := c.readMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(p) != "hello" {
+			t.Errorf("message %d: got %q", i, p)
+		}
+	}
+}
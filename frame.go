@@ -0,0 +1,171 @@
+package kawka
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"unicode/utf8"
+
+	websocket "github.com/gobwas/ws"
+)
+
+// errClosed is returned by readMessage after the closing handshake is done.
+var errClosed = errors.New("kawka: connection closed by client")
+
+// errMessageTooBig is returned for the frames and the messages exceeding
+// the size limits.
+var errMessageTooBig = errors.New("kawka: message too big")
+
+// closeError is returned by readMessage when the connection must be closed
+// with the given status code.
+type closeError struct {
+	code   websocket.StatusCode
+	reason string
+}
+
+func (e closeError) Error() string {
+	return e.reason
+}
+
+// readMessage reads the next data message from the client.
+//
+// Fragmented messages are reassembled, pings are answered with pongs and
+// a close frame completes the closing handshake, in which case errClosed
+// is returned. Protocol violations and oversized messages are reported as
+// closeError.
+func (c *conn) readMessage() (websocket.OpCode, []byte, error) {
+	var (
+		state      = websocket.StateServerSide
+		op         websocket.OpCode
+		payload    []byte
+		compressed bool
+	)
+	if c.deflate != nil {
+		state = state.Set(websocket.StateExtended)
+	}
+
+	for {
+		header, err := websocket.ReadHeader(c.r)
+		if err != nil {
+			return 0, nil, err
+		}
+		c.metrics.frames.Inc(1)
+		c.metrics.bytes.Inc(header.Length)
+
+		if err := websocket.CheckHeader(header, state); err != nil {
+			return 0, nil, closeError{websocket.StatusProtocolError, err.Error()}
+		}
+		// The only extension is permessage-deflate, which allows rsv1 on
+		// the first frame of a data message.
+		if header.Rsv2() || header.Rsv3() || header.Rsv1() &&
+			(header.OpCode.IsControl() || header.OpCode == websocket.OpContinuation) {
+			return 0, nil, closeError{websocket.StatusProtocolError, websocket.ErrProtocolNonZeroRsv.Error()}
+		}
+		// The limits are checked before the payload is allocated.
+		if c.maxFrame > 0 && header.Length > c.maxFrame ||
+			c.maxMessage > 0 && int64(len(payload))+header.Length > c.maxMessage {
+			return 0, nil, closeError{websocket.StatusMessageTooBig, errMessageTooBig.Error()}
+		}
+
+		p, err := c.readPayload(header.Length)
+		if err != nil {
+			return 0, nil, err
+		}
+		if header.Masked {
+			unmask(p, header.Mask)
+		}
+
+		if header.OpCode.IsControl() {
+			if err := c.handleControl(header.OpCode, p); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+
+		if header.OpCode != websocket.OpContinuation {
+			op = header.OpCode
+			compressed = header.Rsv1()
+		}
+		payload = append(payload, p...)
+
+		if !header.Fin {
+			state = state.Set(websocket.StateFragmented)
+			continue
+		}
+		if compressed {
+			if payload, err = c.deflate.decompress(payload, c.maxMessage); err == errMessageTooBig {
+				return 0, nil, closeError{websocket.StatusMessageTooBig, err.Error()}
+			} else if err != nil {
+				return 0, nil, closeError{websocket.StatusInvalidFramePayloadData, err.Error()}
+			}
+		}
+		if op == websocket.OpText && !utf8.Valid(payload) {
+			return 0, nil, closeError{websocket.StatusInvalidFramePayloadData, "invalid utf8 in text message"}
+		}
+		c.metrics.messages.Inc(1)
+		return op, payload, nil
+	}
+}
+
+// readPayload reads the n bytes of a frame payload. The length is chosen
+// by the client, so without the size limits the payload is read through a
+// growing buffer instead of being allocated up front.
+func (c *conn) readPayload(n int64) ([]byte, error) {
+	if c.maxFrame > 0 || c.maxMessage > 0 {
+		// TODO: use pool
+		p := make([]byte, n)
+		if _, err := io.ReadFull(c.r, p); err != nil {
+			return nil, err
+		}
+		return p, nil
+	}
+
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, c.r, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// unmask XORs p with the mask of a client frame, which also masks it.
+// websocket.Cipher is not used, its pointer arithmetic fails the checkptr
+// instrumentation of the race detector.
+func unmask(p []byte, mask [4]byte) {
+	for i := range p {
+		p[i] ^= mask[i&3]
+	}
+}
+
+// handleControl answers a control frame received from the client.
+func (c *conn) handleControl(op websocket.OpCode, p []byte) error {
+	switch op {
+	case websocket.OpPing:
+		return c.writeFrame(websocket.NewPongFrame(p))
+
+	case websocket.OpPong:
+		return nil
+
+	case websocket.OpClose:
+		// A close frame may have no body, otherwise it starts with a
+		// status code followed by an optional UTF-8 reason.
+		if len(p) == 0 {
+			c.shutdown(websocket.StatusNormalClosure, "")
+			return errClosed
+		}
+		if len(p) == 1 {
+			return closeError{websocket.StatusProtocolError, "malformed close frame"}
+		}
+		code, reason := websocket.ParseCloseFrameData(p)
+		if err := websocket.CheckCloseFrameData(code, reason); err != nil {
+			return closeError{websocket.StatusProtocolError, err.Error()}
+		}
+		c.shutdown(code, "")
+		return errClosed
+
+	default:
+		return closeError{websocket.StatusProtocolError, websocket.ErrProtocolOpCodeReserved.Error()}
+	}
+}
@@ -0,0 +1,257 @@
+package kawka
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	websocket "github.com/gobwas/ws"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// bufConn is a net.Conn reading the client frames from in and collecting
+// the server frames in out.
+type bufConn struct {
+	net.Conn
+	in  *bytes.Buffer
+	out *bytes.Buffer
+}
+
+func (c *bufConn) Read(p []byte) (int, error)          { return c.in.Read(p) }
+func (c *bufConn) Write(p []byte) (int, error)         { return c.out.Write(p) }
+func (c *bufConn) Close() error                        { return nil }
+func (c *bufConn) SetReadDeadline(time.Time) error     { return nil }
+func (c *bufConn) SetWriteDeadline(time.Time) error    { return nil }
+func (c *bufConn) RemoteAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *bufConn) SetDeadline(time.Time) error         { return nil }
+func (c *bufConn) LocalAddr() net.Addr                 { return &net.TCPAddr{} }
+func (c *bufConn) readFrame() (websocket.Frame, error) { return websocket.ReadFrame(c.out) }
+
+// newTestConn returns an upgraded conn reading frames, which are masked
+// like the frames of a client.
+func newTestConn(t *testing.T, frames ...websocket.Frame) (*conn, *bufConn) {
+	in := new(bytes.Buffer)
+	for _, f := range frames {
+		if err := websocket.WriteFrame(in, maskFrame(f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	bc := &bufConn{in: in, out: new(bytes.Buffer)}
+	c := &conn{
+		Conn:     bc,
+		r:        bc,
+		quit:     make(chan struct{}),
+		metrics:  newMetrics(metrics.NewRegistry()),
+		upgraded: 1,
+	}
+	return c, bc
+}
+
+// maskFrame returns f masked like the frames of a client.
+func maskFrame(f websocket.Frame) websocket.Frame {
+	f.Header.Masked = true
+	f.Header.Mask = [4]byte{0x1f, 0x2e, 0x3d, 0x4c}
+	f.Payload = append([]byte(nil), f.Payload...)
+	unmask(f.Payload, f.Header.Mask)
+	return f
+}
+
+func fragment(op websocket.OpCode, fin bool, p string) websocket.Frame {
+	return websocket.NewFrame(op, fin, []byte(p))
+}
+
+func TestReadMessageFragmented(t *testing.T) {
+	c, bc := newTestConn(t,
+		fragment(websocket.OpText, false, "hel"),
+		websocket.NewPingFrame([]byte("ping")),
+		fragment(websocket.OpContinuation, false, "lo, \xe4\xb8"),
+		fragment(websocket.OpContinuation, true, "\x96\xe7\x95\x8c"),
+		websocket.NewBinaryFrame([]byte{0xff}),
+	)
+
+	op, p, err := c.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != websocket.OpText || string(p) != "hello, 世界" {
+		t.Errorf("got %v %q", op, p)
+	}
+
+	pong, err := bc.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pong.Header.OpCode != websocket.OpPong || string(pong.Payload) != "ping" {
+		t.Errorf("got %v %q, want the pong of the ping", pong.Header.OpCode, pong.Payload)
+	}
+
+	op, p, err = c.readMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != websocket.OpBinary || !bytes.Equal(p, []byte{0xff}) {
+		t.Errorf("got %v %q", op, p)
+	}
+}
+
+func TestReadMessageClose(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		data []byte
+		code websocket.StatusCode
+	}{
+		{"empty", nil, websocket.StatusNormalClosure},
+		{"normal", websocket.NewCloseFrameData(websocket.StatusNormalClosure, "bye"), websocket.StatusNormalClosure},
+		{"going away", websocket.NewCloseFrameData(websocket.StatusGoingAway, ""), websocket.StatusGoingAway},
+		{"private", websocket.NewCloseFrameData(4000, ""), 4000},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, bc := newTestConn(t, websocket.NewFrame(websocket.OpClose, true, test.data))
+			if _, _, err := c.readMessage(); err != errClosed {
+				t.Fatalf("got %v, want errClosed", err)
+			}
+
+			f, err := bc.readFrame()
+			if err != nil {
+				t.Fatal(err)
+			}
+			code, _ := websocket.ParseCloseFrameData(f.Payload)
+			if f.Header.OpCode != websocket.OpClose || code != test.code {
+				t.Errorf("got %v %v, want the close frame with %v", f.Header.OpCode, code, test.code)
+			}
+		})
+	}
+}
+
+func TestReadMessageErrors(t *testing.T) {
+	rsv1 := websocket.NewTextFrame("x")
+	rsv1.Header.Rsv = websocket.Rsv(true, false, false)
+
+	for _, test := range []struct {
+		name   string
+		frames []websocket.Frame
+		code   websocket.StatusCode
+	}{
+		{
+			name:   "continuation first",
+			frames: []websocket.Frame{fragment(websocket.OpContinuation, true, "x")},
+			code:   websocket.StatusProtocolError,
+		},
+		{
+			name: "data in fragments",
+			frames: []websocket.Frame{
+				fragment(websocket.OpText, false, "x"),
+				fragment(websocket.OpText, true, "y"),
+			},
+			code: websocket.StatusProtocolError,
+		},
+		{
+			name:   "fragmented ping",
+			frames: []websocket.Frame{fragment(websocket.OpPing, false, "x")},
+			code:   websocket.StatusProtocolError,
+		},
+		{
+			name:   "reserved opcode",
+			frames: []websocket.Frame{fragment(0x3, true, "x")},
+			code:   websocket.StatusProtocolError,
+		},
+		{
+			name:   "rsv1 without deflate",
+			frames: []websocket.Frame{rsv1},
+			code:   websocket.StatusProtocolError,
+		},
+		{
+			name:   "close with one byte",
+			frames: []websocket.Frame{websocket.NewFrame(websocket.OpClose, true, []byte{0x03})},
+			code:   websocket.StatusProtocolError,
+		},
+		{
+			name:   "close with reserved code",
+			frames: []websocket.Frame{websocket.NewCloseFrame(websocket.StatusNoStatusRcvd, "")},
+			code:   websocket.StatusProtocolError,
+		},
+		{
+			name:   "close with unknown code",
+			frames: []websocket.Frame{websocket.NewCloseFrame(999, "")},
+			code:   websocket.StatusProtocolError,
+		},
+		{
+			name:   "close with invalid utf8 reason",
+			frames: []websocket.Frame{websocket.NewCloseFrame(websocket.StatusNormalClosure, "\xff")},
+			code:   websocket.StatusProtocolError,
+		},
+		{
+			name:   "invalid utf8",
+			frames: []websocket.Frame{websocket.NewTextFrame("a\xffb")},
+			code:   websocket.StatusInvalidFramePayloadData,
+		},
+		{
+			name: "invalid utf8 in fragments",
+			frames: []websocket.Frame{
+				fragment(websocket.OpText, false, "\xe4\xb8"),
+				fragment(websocket.OpContinuation, true, "x"),
+			},
+			code: websocket.StatusInvalidFramePayloadData,
+		},
+		{
+			name:   "frame too big",
+			frames: []websocket.Frame{websocket.NewTextFrame("0123456789")},
+			code:   websocket.StatusMessageTooBig,
+		},
+		{
+			name: "message too big",
+			frames: []websocket.Frame{
+				fragment(websocket.OpText, false, "0123"),
+				fragment(websocket.OpContinuation, false, "4567"),
+				fragment(websocket.OpContinuation, true, "89"),
+			},
+			code: websocket.StatusMessageTooBig,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			c, _ := newTestConn(t, test.frames...)
+			c.maxFrame = 8
+			c.maxMessage = 9
+
+			_, _, err := c.readMessage()
+			ce, ok := err.(closeError)
+			if !ok {
+				t.Fatalf("got %v, want a closeError", err)
+			}
+			if ce.code != test.code {
+				t.Errorf("got %v (%s), want %v", ce.code, ce.reason, test.code)
+			}
+		})
+	}
+}
+
+func TestReadMessageUnlimited(t *testing.T) {
+	c, bc := newTestConn(t, websocket.NewTextFrame("hello"))
+	c.maxFrame, c.maxMessage = 0, 0
+
+	if _, p, err := c.readMessage(); err != nil || string(p) != "hello" {
+		t.Fatalf("got %q, %v", p, err)
+	}
+
+	// The length is not allocated before the payload is read.
+	header := websocket.Header{Fin: true, OpCode: websocket.OpText, Masked: true, Length: 1 << 62}
+	if err := websocket.WriteHeader(bc.in, header); err != nil {
+		t.Fatal(err)
+	}
+	bc.in.WriteString("short")
+	if _, _, err := c.readMessage(); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestReadMessageUnmasked(t *testing.T) {
+	c, bc := newTestConn(t)
+	websocket.WriteFrame(bc.in, websocket.NewTextFrame("x"))
+
+	_, _, err := c.readMessage()
+	if ce, ok := err.(closeError); !ok || ce.code != websocket.StatusProtocolError {
+		t.Errorf("got %v, want a protocol error", err)
+	}
+}
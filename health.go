@@ -0,0 +1,201 @@
+package kawka
+
+import (
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	kafka "github.com/Shopify/sarama"
+)
+
+const (
+	// readyInterval is the period of checking the broker connectivity in
+	// the background, the readiness probes get the last result.
+	readyInterval = 5 * time.Second
+
+	// readyTimeout bounds a broker check.
+	readyTimeout = 3 * time.Second
+)
+
+var (
+	errShuttingDown  = errors.New("kawka: server is shutting down")
+	errNotListening  = errors.New("kawka: listener is not running")
+	errNoBrokers     = errors.New("kawka: no brokers available")
+	errBrokerTimeout = errors.New("kawka: broker check timed out")
+)
+
+// brokerCheck checks the brokers periodically from the first readiness
+// probe until Kawka is stopped.
+type brokerCheck struct {
+	mu      sync.Mutex
+	err     error
+	checked chan struct{} // closed when the first check is done
+	stop    chan struct{}
+	done    chan struct{}
+	closed  bool
+}
+
+// Ready reports whether Kawka can take traffic: it is not shutting down,
+// its listener is running if it was started with Start, and the brokers
+// are reachable.
+func (wk *Kawka) Ready() error {
+	wk.mu.Lock()
+	closing, started, listening := wk.closing, wk.started, wk.listener != nil
+	wk.mu.Unlock()
+
+	if closing {
+		return errShuttingDown
+	}
+	if started && !listening {
+		return errNotListening
+	}
+	return wk.brokerCheck.result(wk.checkBrokers)
+}
+
+// result returns the result of the last check, starting the checks on the
+// first call.
+func (bc *brokerCheck) result(check func() error) error {
+	bc.mu.Lock()
+	if bc.closed {
+		bc.mu.Unlock()
+		return errShuttingDown
+	}
+	if bc.stop == nil {
+		bc.checked = make(chan struct{})
+		bc.stop = make(chan struct{})
+		bc.done = make(chan struct{})
+		go bc.run(check)
+	}
+	checked := bc.checked
+	bc.mu.Unlock()
+
+	t := time.NewTimer(readyTimeout)
+	defer t.Stop()
+	select {
+	case <-checked:
+	case <-t.C:
+		return errBrokerTimeout
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.err
+}
+
+// run checks the brokers every readyInterval until the check is closed.
+// A check taking longer than readyTimeout is reported as failed until it
+// is done, the next one starts only then.
+func (bc *brokerCheck) run(check func() error) {
+	defer close(bc.done)
+
+	for {
+		res := make(chan error, 1)
+		go func() { res <- check() }()
+
+		timeout := time.NewTimer(readyTimeout)
+		select {
+		case err := <-res:
+			bc.set(err)
+		case <-timeout.C:
+			bc.set(errBrokerTimeout)
+			select {
+			case err := <-res:
+				bc.set(err)
+			case <-bc.stop:
+				return
+			}
+		case <-bc.stop:
+			timeout.Stop()
+			return
+		}
+		timeout.Stop()
+
+		select {
+		case <-time.After(readyInterval):
+		case <-bc.stop:
+			return
+		}
+	}
+}
+
+func (bc *brokerCheck) set(err error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.err = err
+	select {
+	case <-bc.checked:
+	default:
+		close(bc.checked)
+	}
+}
+
+// close stops the checks.
+func (bc *brokerCheck) close() {
+	bc.mu.Lock()
+	bc.closed = true
+	stop := bc.stop
+	bc.mu.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-bc.done
+	}
+}
+
+// checkBrokers reports whether any broker answers a request. Unlike
+// refreshing the metadata it does not fetch all the topics: the brokers of
+// Kafka 0.10+ are asked for their API versions, the older ones are only
+// connected to.
+func (wk *Kawka) checkBrokers() error {
+	brokers := wk.client.Brokers()
+	if len(brokers) == 0 {
+		return errNoBrokers
+	}
+
+	var err error
+	for _, b := range brokers {
+		// Open does not block, Connected waits for the connection.
+		b.Open(wk.config)
+		var ok bool
+		if ok, err = b.Connected(); !ok {
+			if err == nil {
+				err = errNoBrokers
+			}
+			continue
+		}
+		if !wk.config.Version.IsAtLeast(kafka.V0_10_0_0) {
+			return nil
+		}
+		if _, err = b.ApiVersions(&kafka.ApiVersionsRequest{}); err == nil {
+			return nil
+		}
+		// The connection is reopened on the next check, as sarama does
+		// on failed requests.
+		b.Close()
+	}
+	return err
+}
+
+// HealthHandler returns an http.Handler of the liveness probe. It succeeds
+// as long as the process serves requests.
+func (wk *Kawka) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+}
+
+// ReadyHandler returns an http.Handler of the readiness probe, which
+// fails with 503 unless Ready succeeds.
+func (wk *Kawka) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := wk.Ready(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ok\n"))
+	})
+}
@@ -0,0 +1,83 @@
+package kawka
+
+import (
+	"net/http"
+
+	websocket "github.com/gobwas/ws"
+)
+
+// headerSecExtensions is the canonical Sec-WebSocket-Extensions header key.
+const headerSecExtensions = "Sec-Websocket-Extensions"
+
+// Handler returns Kawka as an http.Handler, so it could be mounted on an
+// existing http.ServeMux next to other routes.
+func (wk *Kawka) Handler() http.Handler {
+	return wk
+}
+
+// ServeHTTP upgrades the request to WebSocket and serves the connection
+// until it is closed. Messages are processed the same way as for the
+// connections accepted by Start.
+func (wk *Kawka) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if wk.isClosing() {
+		http.Error(w, "kawka: server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	ip := remoteIP(r.RemoteAddr)
+	if err := wk.acquireSlot(ip); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	defer wk.releaseSlot(ip)
+
+	if err := wk.checkOrigin(r.Header.Get("Origin"), r.RemoteAddr); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	claims, ok := wk.authenticate(&HandshakeRequest{
+		RemoteAddr: r.RemoteAddr,
+		URL:        r.URL,
+		Header:     r.Header,
+	})
+	if !ok {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, errUnauthorized.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	var (
+		header http.Header
+		dfl    *deflater
+	)
+	if wk.deflate != nil {
+		for _, v := range r.Header[headerSecExtensions] {
+			if params, opt, ok := wk.deflate.negotiate([]byte(v)); ok {
+				header = http.Header{headerSecExtensions: {headerValue(opt)}}
+				dfl = newDeflater(params, wk.deflate.Level)
+				break
+			}
+		}
+	}
+
+	nc, rw, _, err := websocket.UpgradeHTTP(r, w, header)
+	if err != nil {
+		wk.logger.Warn("error on upgrade", "remote", r.RemoteAddr, "err", err)
+		return
+	}
+
+	c := wk.newConn(nc)
+	c.r = rw.Reader
+	c.deflate = dfl
+	c.peer.Claims = claims
+	c.setTLSState(r.TLS)
+
+	if !wk.trackConn(c) {
+		nc.Close()
+		return
+	}
+	defer wk.untrackConn(c)
+
+	wk.serveConn(c)
+}
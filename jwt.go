@@ -0,0 +1,230 @@
+package kawka
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// defaultTokenParam is the query parameter of the token for the clients
+// unable to set the Authorization header, like browsers.
+const defaultTokenParam = "access_token"
+
+var (
+	errNoToken        = errors.New("kawka: no token")
+	errMalformedToken = errors.New("kawka: malformed token")
+	errTokenSignature = errors.New("kawka: invalid token signature")
+	errTokenExpired   = errors.New("kawka: token is expired")
+	errTokenNotValid  = errors.New("kawka: token is not valid yet")
+)
+
+// JWTConfig configures the authentication of clients with JSON Web Tokens
+// signed with HS256 or RS256. At least one of the key files is required,
+// the tokens signed with any other algorithm are rejected.
+type JWTConfig struct {
+	// HMACKeyFile is the file with the secret of the HS256 tokens.
+	HMACKeyFile string
+
+	// RSAKeyFile is the PEM file with the RSA public key or the
+	// certificate verifying the RS256 tokens.
+	RSAKeyFile string
+
+	// QueryParam is the query parameter the token is read from when
+	// there is no Authorization header. Default is "access_token".
+	QueryParam string
+
+	// Issuer and Audience, if set, must match the iss and aud claims.
+	Issuer   string
+	Audience string
+
+	// Leeway is the allowed clock skew when checking the exp and nbf
+	// claims.
+	Leeway time.Duration
+}
+
+// jwtVerifier verifies the tokens configured by JWTConfig.
+type jwtVerifier struct {
+	cfg     JWTConfig
+	hmacKey []byte
+	rsaKey  *rsa.PublicKey
+	now     func() time.Time
+}
+
+// NewJWTAuthenticator returns an Authenticator verifying the bearer tokens
+// of the clients as configured by cfg.
+func NewJWTAuthenticator(cfg JWTConfig) (Authenticator, error) {
+	v := &jwtVerifier{cfg: cfg, now: time.Now}
+	if v.cfg.QueryParam == "" {
+		v.cfg.QueryParam = defaultTokenParam
+	}
+	if cfg.HMACKeyFile == "" && cfg.RSAKeyFile == "" {
+		return nil, errors.New("kawka: JWT requires a key file")
+	}
+
+	if cfg.HMACKeyFile != "" {
+		data, err := ioutil.ReadFile(cfg.HMACKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.hmacKey = bytes.TrimRight(data, "\r\n")
+		if len(v.hmacKey) == 0 {
+			return nil, errors.New("kawka: HMAC key file is empty")
+		}
+	}
+	if cfg.RSAKeyFile != "" {
+		key, err := loadRSAPublicKey(cfg.RSAKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		v.rsaKey = key
+	}
+
+	return func(req *HandshakeRequest) (Claims, error) {
+		token := req.Token(v.cfg.QueryParam)
+		if token == "" {
+			return nil, errNoToken
+		}
+		return v.verify(token)
+	}, nil
+}
+
+// verify checks the signature and the registered claims of token.
+func (v *jwtVerifier) verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errMalformedToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errMalformedToken
+	}
+	signed := token[:len(parts[0])+1+len(parts[1])]
+
+	switch {
+	case header.Alg == "HS256" && v.hmacKey != nil:
+		mac := hmac.New(sha256.New, v.hmacKey)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(sig, mac.Sum(nil)) {
+			return nil, errTokenSignature
+		}
+	case header.Alg == "RS256" && v.rsaKey != nil:
+		sum := sha256.Sum256([]byte(signed))
+		if rsa.VerifyPKCS1v15(v.rsaKey, crypto.SHA256, sum[:], sig) != nil {
+			return nil, errTokenSignature
+		}
+	default:
+		return nil, errors.New("kawka: unexpected token algorithm " + header.Alg)
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if err := v.validate(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// validate checks the time, the issuer and the audience of claims.
+func (v *jwtVerifier) validate(claims Claims) error {
+	now := v.now()
+	if exp, ok := claims["exp"].(float64); ok && now.Add(-v.cfg.Leeway).After(unixTime(exp)) {
+		return errTokenExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.cfg.Leeway).Before(unixTime(nbf)) {
+		return errTokenNotValid
+	}
+	if v.cfg.Issuer != "" && claims["iss"] != v.cfg.Issuer {
+		return errors.New("kawka: unexpected token issuer")
+	}
+	if v.cfg.Audience != "" && !hasAudience(claims["aud"], v.cfg.Audience) {
+		return errors.New("kawka: unexpected token audience")
+	}
+	return nil
+}
+
+// hasAudience reports whether the aud claim, a string or a list of
+// strings, contains audience.
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func unixTime(sec float64) time.Time {
+	return time.Unix(0, int64(sec*float64(time.Second)))
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return errMalformedToken
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errMalformedToken
+	}
+	return nil
+}
+
+// loadRSAPublicKey reads the PEM encoded RSA public key or certificate
+// from name.
+func loadRSAPublicKey(name string) (*rsa.PublicKey, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("kawka: no PEM data in " + name)
+	}
+
+	var key interface{}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		key = cert.PublicKey
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("kawka: not an RSA public key in " + name)
+	}
+	return rsaKey, nil
+}
@@ -0,0 +1,193 @@
+package kawka
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	testHMACKey = []byte("secret")
+	testNow     = time.Unix(1500000000, 0)
+)
+
+// signToken returns a token of claims signed with alg, in any case. The
+// key is the HMAC secret for HS256 and an *rsa.PrivateKey for RS256, other
+// algorithms are not signed.
+func signToken(t *testing.T, alg string, key interface{}, claims Claims) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "typ": "JWT"})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var sig []byte
+	switch strings.ToUpper(alg) {
+	case "HS256":
+		mac := hmac.New(sha256.New, key.([]byte))
+		mac.Write([]byte(signed))
+		sig = mac.Sum(nil)
+	case "RS256":
+		sum := sha256.Sum256([]byte(signed))
+		if sig, err = rsa.SignPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), crypto.SHA256, sum[:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTVerify(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+
+	hmacOnly := &jwtVerifier{hmacKey: testHMACKey}
+	rsaOnly := &jwtVerifier{rsaKey: &rsaKey.PublicKey}
+	both := &jwtVerifier{hmacKey: testHMACKey, rsaKey: &rsaKey.PublicKey}
+	audience := &jwtVerifier{hmacKey: testHMACKey, cfg: JWTConfig{Issuer: "auth", Audience: "kawka"}}
+	leeway := &jwtVerifier{hmacKey: testHMACKey, cfg: JWTConfig{Leeway: time.Minute}}
+
+	now := float64(testNow.Unix())
+	valid := Claims{"sub": "alice", "exp": now + 60}
+	hsToken := signToken(t, "HS256", testHMACKey, valid)
+
+	for _, test := range []struct {
+		name  string
+		v     *jwtVerifier
+		token string
+		ok    bool
+	}{
+		{"hs256", hmacOnly, hsToken, true},
+		{"rs256", rsaOnly, signToken(t, "RS256", rsaKey, valid), true},
+		{"both keys", both, signToken(t, "RS256", rsaKey, valid), true},
+		{"no claims", hmacOnly, signToken(t, "HS256", testHMACKey, Claims{}), true},
+
+		{"alg none", hmacOnly, signToken(t, "none", nil, valid), false},
+		{"alg none with both keys", both, signToken(t, "none", nil, valid), false},
+		{"alg lower case", hmacOnly, signToken(t, "hs256", testHMACKey, valid), false},
+		{"alg hs384", hmacOnly, signToken(t, "HS384", nil, valid), false},
+		// The public key is known to everybody, it must not be taken as
+		// the HMAC secret.
+		{"alg swap to hs256", rsaOnly, signToken(t, "HS256", publicPEM, valid), false},
+		{"alg swap to hs256 with der", rsaOnly, signToken(t, "HS256", der, valid), false},
+		{"alg swap to rs256", hmacOnly, signToken(t, "RS256", rsaKey, valid), false},
+
+		{"bad hmac signature", hmacOnly, signToken(t, "HS256", []byte("other"), valid), false},
+		{"bad rsa signature", rsaOnly, signToken(t, "RS256", mustRSAKey(t), valid), false},
+		{"tampered claims", hmacOnly, tamper(hsToken, Claims{"sub": "admin"}), false},
+		{"no signature", hmacOnly, hsToken[:strings.LastIndex(hsToken, ".")+1], false},
+
+		{"two segments", hmacOnly, "e30.e30", false},
+		{"bad base64", hmacOnly, "e30.e30.!!!", false},
+		{"bad header", hmacOnly, "bm90IGpzb24.e30.", false},
+
+		{"expired", hmacOnly, signToken(t, "HS256", testHMACKey, Claims{"exp": now - 1}), false},
+		{"expired within leeway", leeway, signToken(t, "HS256", testHMACKey, Claims{"exp": now - 30}), true},
+		{"expired past leeway", leeway, signToken(t, "HS256", testHMACKey, Claims{"exp": now - 90}), false},
+		{"not valid yet", hmacOnly, signToken(t, "HS256", testHMACKey, Claims{"nbf": now + 1}), false},
+		{"not valid yet within leeway", leeway, signToken(t, "HS256", testHMACKey, Claims{"nbf": now + 30}), true},
+		{"valid since", hmacOnly, signToken(t, "HS256", testHMACKey, Claims{"nbf": now}), true},
+
+		{"audience", audience, signToken(t, "HS256", testHMACKey, Claims{"iss": "auth", "aud": "kawka"}), true},
+		{"audience list", audience, signToken(t, "HS256", testHMACKey, Claims{"iss": "auth", "aud": []string{"billing", "kawka"}}), true},
+		{"other audience", audience, signToken(t, "HS256", testHMACKey, Claims{"iss": "auth", "aud": "billing"}), false},
+		{"other audience list", audience, signToken(t, "HS256", testHMACKey, Claims{"iss": "auth", "aud": []string{"billing"}}), false},
+		{"no audience", audience, signToken(t, "HS256", testHMACKey, Claims{"iss": "auth"}), false},
+		{"other issuer", audience, signToken(t, "HS256", testHMACKey, Claims{"iss": "evil", "aud": "kawka"}), false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			v := *test.v
+			v.now = func() time.Time { return testNow }
+
+			claims, err := v.verify(test.token)
+			if test.ok && err != nil {
+				t.Fatalf("got %v, want the token verified", err)
+			}
+			if !test.ok && err == nil {
+				t.Fatalf("got claims %v, want the token rejected", claims)
+			}
+		})
+	}
+}
+
+func mustRSAKey(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+// tamper replaces the claims of token keeping its signature.
+func tamper(token string, claims Claims) string {
+	parts := strings.Split(token, ".")
+	payload, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	keyFile := filepath.Join(t.TempDir(), "hmac.key")
+	if err := ioutil.WriteFile(keyFile, append(testHMACKey, '\n'), 0600); err != nil {
+		t.Fatal(err)
+	}
+	auth, err := NewJWTAuthenticator(JWTConfig{HMACKeyFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := signToken(t, "HS256", testHMACKey, Claims{"sub": "alice"})
+
+	for _, test := range []struct {
+		name   string
+		header string
+		query  string
+		ok     bool
+	}{
+		{"header", "Bearer " + token, "", true},
+		{"header case", "bearer " + token, "", true},
+		{"query", "", "access_token=" + token, true},
+		{"header before query", "Bearer " + token, "access_token=bad", true},
+		{"bad header", "Bearer bad", "access_token=" + token, false},
+		{"basic", "Basic YWxpY2U6c2VjcmV0", "", false},
+		{"other query", "", "token=" + token, false},
+		{"none", "", "", false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			req := &HandshakeRequest{
+				URL:    &url.URL{Path: "/", RawQuery: test.query},
+				Header: http.Header{},
+			}
+			if test.header != "" {
+				req.Header.Set("Authorization", test.header)
+			}
+
+			claims, err := auth(req)
+			if test.ok && (err != nil || claims["sub"] != "alice") {
+				t.Fatalf("got %v, %v, want the claims of alice", claims, err)
+			}
+			if !test.ok && err == nil {
+				t.Fatalf("got claims %v, want an error", claims)
+			}
+		})
+	}
+}
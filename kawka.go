@@ -1,26 +1,107 @@
 package kawka
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"errors"
 	"io"
-	"log"
 	"net"
+	"net/http"
+	"net/url"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	kafka "github.com/Shopify/sarama"
+	"github.com/gobwas/httphead"
 	websocket "github.com/gobwas/ws"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// ErrServerClosed is returned by Start after Shutdown has been called.
+var ErrServerClosed = errors.New("kawka: server closed")
+
+var (
+	errTooManyConns      = errors.New("kawka: too many connections")
+	errTooManyConnsPerIP = errors.New("kawka: too many connections from the IP")
+)
+
+// Defaults of the connection limits.
+const (
+	defaultHandshakeTimeout = 10 * time.Second
+	defaultMaxMessageSize   = 1 << 20
 )
 
 // MessageHandler ...
+//
+// It is the simple form of RecordHandler.
 type MessageHandler func(data []byte) (topic string, content []byte, err error)
 
 // Kawka ...
 type Kawka struct {
 	port     int
-	producer kafka.SyncProducer
+	addr     string
+	client   kafka.Client
+	producer kafka.AsyncProducer
 	brokers  []string
-	handler  MessageHandler
+	config   *kafka.Config
+	handler  RecordHandler
 	stream   chan []byte
+
+	tlsConfig     *tls.Config
+	certs         *certReloader
+	clientCAs     *x509.CertPool
+	authorizer    Authorizer
+	authenticator Authenticator
+	policy        *Policy
+	origins       *OriginConfig
+	rateLimit     *RateLimitConfig
+	ipLimits      *ipLimiters
+	deflate       *DeflateConfig
+	acks          bool
+
+	partitioner kafka.PartitionerConstructor
+	maxInFlight int
+	dispatched  chan struct{}
+
+	deadLetterTopic string
+	deadLetters     sync.WaitGroup // dead-letter records being sent
+
+	spoolConfig *SpoolConfig
+	spool       *spool
+
+	metrics     *kawkaMetrics
+	metricsAddr string
+	admin       *http.Server
+	brokerCheck brokerCheck
+
+	subscriptions bool
+
+	shutdownTimeout time.Duration
+
+	maxConns         int
+	maxConnsPerIP    int
+	handshakeTimeout time.Duration
+	maxFrameSize     int64
+	maxMessageSize   int64
+
+	logger Logger
+
+	mu       sync.Mutex
+	listener net.Listener
+	started  bool
+	conns    map[*conn]struct{}
+	slots    int
+	ipSlots  map[string]int
+	closing  bool
+	wg       sync.WaitGroup
+	lastID   uint64
+	stopOnce sync.Once
+	stopErr  error
 }
 
 // Message ...
@@ -31,111 +112,498 @@ type Message struct {
 }
 
 // New ...
+//
+// It panics if Kawka cannot be created, see Open.
 func New(opts ...Option) *Kawka {
+	wk, err := Open(opts...)
+	if err != nil {
+		panic(err)
+	}
+	return wk
+}
+
+// Open creates Kawka with the given options and connects to the brokers.
+// Unlike New it returns an error if the options are invalid or the brokers
+// are unreachable.
+func Open(opts ...Option) (*Kawka, error) {
+	wk, err := newKawka(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := wk.initTLS(); err != nil {
+		return nil, err
+	}
+
+	if err := wk.initProducer(wk.brokers); err != nil {
+		return nil, err
+	}
+
+	if err := wk.initSpool(); err != nil {
+		wk.closeKafka()
+		return nil, err
+	}
+	return wk, nil
+}
+
+// Check validates the options and connects to the brokers like Open, then
+// disconnects. Nothing is started: the spool directory is checked but the
+// spool is neither opened nor replayed.
+func Check(opts ...Option) error {
+	wk, err := newKawka(opts)
+	if err != nil {
+		return err
+	}
+	if err := wk.checkSpool(); err != nil {
+		return err
+	}
+
+	if err := wk.initTLS(); err != nil {
+		return err
+	}
+	if err := wk.initProducer(wk.brokers); err != nil {
+		return err
+	}
+	err = wk.checkBrokers()
+	if cerr := wk.closeKafka(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// newKawka creates Kawka with the given options without connecting to the
+// brokers.
+func newKawka(opts []Option) (*Kawka, error) {
+	config := kafka.NewConfig()
+	config.Version = kafka.V0_10_0_1
+
 	wk := &Kawka{
-		handler: defaultMessageHandler,
-		stream:  make(chan []byte),
+		config:           config,
+		handler:          defaultHandler,
+		stream:           make(chan []byte),
+		shutdownTimeout:  10 * time.Second,
+		handshakeTimeout: defaultHandshakeTimeout,
+		maxMessageSize:   defaultMaxMessageSize,
+		partitioner:      kafka.NewHashPartitioner,
+		conns:            make(map[*conn]struct{}),
+		ipSlots:          make(map[string]int),
+		logger:           NewLogger(os.Stderr, LevelInfo),
 	}
 
 	for _, op := range opts {
 		if err := op(wk); err != nil {
-			panic(err)
+			return nil, err
 		}
 	}
 
-	if err := wk.initProducer(wk.brokers); err != nil {
-		panic(err)
+	// The failures and the client subjects are described by the record
+	// headers, which older versions drop silently.
+	if wk.deadLetterTopic != "" && !wk.headersSupported() {
+		return nil, errors.New("kawka: dead-letter topic requires Kafka version 0.11.0.0 or later")
+	}
+	if wk.clientCAs != nil && !wk.headersSupported() {
+		return nil, errors.New("kawka: client certificates require Kafka version 0.11.0.0 or later")
 	}
 
+	if wk.config.MetricRegistry == nil {
+		wk.config.MetricRegistry = metrics.NewRegistry()
+	}
+	wk.metrics = newMetrics(wk.config.MetricRegistry)
+
 	if wk.handler == nil {
-		wk.handler = defaultMessageHandler
+		wk.handler = defaultHandler
 	}
-	return wk
+	return wk, nil
 }
 
-// Start ...
-func (wk *Kawka) Start() error {
-	ln, err := net.Listen("tcp", ":"+strconv.Itoa(wk.port))
+// Start listens on the configured address or port and serves WebSocket connections
+// until ctx is done or Shutdown is called. If TLS is configured the
+// connections are served as wss://. The metrics are served on their own
+// address, if any.
+//
+// When ctx is done Start shuts Kawka down gracefully, waiting at most the
+// shutdown timeout for in-flight messages, and returns ctx.Err().
+// After Shutdown has been called Start returns ErrServerClosed.
+func (wk *Kawka) Start(ctx context.Context) error {
+	wk.mu.Lock()
+	wk.started = true
+	wk.mu.Unlock()
+
+	addr := wk.addr
+	if addr == "" {
+		addr = ":" + strconv.Itoa(wk.port)
+	}
+	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatal(err)
+		return err
+	}
+	if wk.tlsConfig != nil {
+		ln = tls.NewListener(ln, wk.tlsConfig)
 	}
+	if err := wk.startAdmin(); err != nil {
+		ln.Close()
+		return err
+	}
+	return wk.serve(ctx, ln)
+}
 
+func (wk *Kawka) serve(ctx context.Context, ln net.Listener) error {
+	wk.mu.Lock()
+	if wk.closing {
+		wk.mu.Unlock()
+		ln.Close()
+		return ErrServerClosed
+	}
+	wk.listener = ln
+	wk.mu.Unlock()
+
+	wk.logger.Info("listening", "addr", ln.Addr().String(), "tls", wk.tlsConfig != nil)
+
+	errc := make(chan error, 1)
+	go func() {
+		errc <- wk.accept(ln)
+	}()
+
+	select {
+	case err := <-errc:
+		wk.mu.Lock()
+		wk.listener = nil
+		wk.mu.Unlock()
+		return err
+
+	case <-ctx.Done():
+		sctx, cancel := context.WithTimeout(context.Background(), wk.shutdownTimeout)
+		defer cancel()
+
+		if err := wk.Shutdown(sctx); err != nil {
+			return err
+		}
+		<-errc
+		return ctx.Err()
+	}
+}
+
+func (wk *Kawka) accept(ln net.Listener) error {
+	var delay time.Duration
 	for {
-		conn, err := ln.Accept()
+		nc, err := ln.Accept()
 		if err != nil {
-			// handle error
+			if wk.isClosing() {
+				return ErrServerClosed
+			}
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				wk.logger.Warn("error on accept", "err", err, "retry", delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
 		}
-		_, err = websocket.Upgrade(conn)
-		if err != nil {
-			// handle error
+		delay = 0
+
+		remote := nc.RemoteAddr().String()
+		ip := remoteIP(remote)
+		if err := wk.acquireSlot(ip); err != nil {
+			wk.logger.Debug("connection rejected", "remote", remote, "err", err)
+			nc.Close()
+			continue
+		}
+
+		c := wk.newConn(nc)
+		if !wk.trackConn(c) {
+			wk.releaseSlot(ip)
+			nc.Close()
+			return ErrServerClosed
 		}
 
 		go func() {
-			defer conn.Close()
+			defer wk.releaseSlot(ip)
+			defer wk.untrackConn(c)
 
-			for {
-				header, err := websocket.ReadHeader(conn)
-				if err != nil {
-					// handle error
+			// The deadline covers the TLS handshake as well.
+			if wk.handshakeTimeout > 0 {
+				nc.SetDeadline(time.Now().Add(wk.handshakeTimeout))
+			}
+			u := wk.upgrader(c)
+			if _, err := u.Upgrade(nc); err != nil {
+				// The rejected clients are logged by the callbacks.
+				if err != errUnauthorized && err != errForbiddenOrigin {
+					wk.logger.Warn("error on upgrade", c.peer.keyvals("err", err)...)
 				}
+				nc.Close()
+				return
+			}
+			nc.SetDeadline(time.Time{})
+			if tc, ok := nc.(*tls.Conn); ok {
+				state := tc.ConnectionState()
+				c.setTLSState(&state)
+			}
+			wk.serveConn(c)
+		}()
+	}
+}
 
-				// TODO: use pool
-				payload := make([]byte, header.Length)
-				_, err = io.ReadFull(conn, payload)
-				if err != nil {
-					// handle error
-				}
-				if header.Masked {
-					websocket.Cipher(payload, header.Mask, 0)
-				}
+// upgrader returns the Upgrader performing the handshake of c.
+func (wk *Kawka) upgrader(c *conn) websocket.Upgrader {
+	var u websocket.Upgrader
 
-				topic, content, err := wk.handler(payload)
-				if err != nil {
-					log.Printf("error in handler: %s\n", err.Error())
-					continue
-				}
+	if wk.deflate != nil {
+		u.ExtensionCustom = func(header []byte, selected []httphead.Option) ([]httphead.Option, bool) {
+			if c.deflate != nil {
+				return selected, true
+			}
+			if params, opt, ok := wk.deflate.negotiate(header); ok {
+				c.deflate = newDeflater(params, wk.deflate.Level)
+				selected = append(selected, opt)
+			}
+			return selected, true
+		}
+	}
 
-				msg := &kafka.ProducerMessage{
-					Topic: topic,
-					Value: kafka.ByteEncoder(content),
+	if wk.authenticator != nil || wk.origins != nil {
+		// The request is collected from the callbacks, as the arguments
+		// are only valid until they return.
+		req := &HandshakeRequest{Header: make(http.Header)}
+		if c.peer.RemoteAddr != nil {
+			req.RemoteAddr = c.peer.RemoteAddr.String()
+		}
+		u.OnRequest = func(host, uri []byte) (error, int) {
+			parsed, err := url.ParseRequestURI(string(uri))
+			if err != nil {
+				return err, http.StatusBadRequest
+			}
+			req.URL = parsed
+			return nil, 0
+		}
+		u.OnHeader = func(key, value []byte) (error, int) {
+			if strings.EqualFold(string(key), "Origin") {
+				if err := wk.checkOrigin(string(value), req.RemoteAddr); err != nil {
+					return err, http.StatusForbidden
 				}
-
-				_, _, err = wk.producer.SendMessage(msg)
-				if err != nil {
-					log.Printf("error on SendMessage: %s\n", err.Error())
-					continue
+			}
+			req.Header.Add(string(key), string(value))
+			return nil, 0
+		}
+		u.OnBeforeUpgrade = func() (func(io.Writer), error, int) {
+			if _, ok := req.Header["Origin"]; !ok {
+				if err := wk.checkOrigin("", req.RemoteAddr); err != nil {
+					return nil, err, http.StatusForbidden
 				}
 			}
-		}()
+			claims, ok := wk.authenticate(req)
+			if !ok {
+				return writeAuthenticate, errUnauthorized, http.StatusUnauthorized
+			}
+			c.peer.Claims = claims
+			return nil, nil, 0
+		}
 	}
+	return u
+}
+
+// Shutdown gracefully stops Kawka without interrupting in-flight messages.
+//
+// It closes the listener, stops reading from live connections and waits
+// until all messages already read from the sockets are produced to Kafka,
+// then every connection is closed with a close frame. Only then the
+// producer is closed.
+//
+// If ctx is done before that, the remaining connections are closed forcibly
+// and ctx.Err() is returned; the producer is left open so Shutdown could be
+// called again to finish the draining.
+func (wk *Kawka) Shutdown(ctx context.Context) error {
+	wk.mu.Lock()
+	wk.closing = true
+	ln := wk.listener
+	conns := make([]*conn, 0, len(wk.conns))
+	for c := range wk.conns {
+		conns = append(conns, c)
+	}
+	wk.mu.Unlock()
+
+	if ln != nil {
+		ln.Close()
+	}
+	wk.logger.Info("shutting down", "conns", len(conns))
+	if err := ctx.Err(); err != nil {
+		for _, c := range conns {
+			c.Close()
+		}
+		return err
+	}
+	for _, c := range conns {
+		c.drain()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wk.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		for _, c := range conns {
+			c.Close()
+		}
+		return ctx.Err()
+	}
+
+	wk.stopOnce.Do(func() {
+		wk.logger.Info("closing kafka producer")
+		wk.stopErr = wk.closeKafka()
+		wk.stopAdmin()
+	})
+	return wk.stopErr
+}
+
+// closeKafka closes the producer and the client it shares with the
+// consumers of the connections.
+func (wk *Kawka) closeKafka() error {
+	wk.brokerCheck.close()
+
+	var err error
+	if wk.spool != nil {
+		err = wk.spool.close()
+	}
+	// The connections and the replay may have sent records to the
+	// dead-letter topic.
+	wk.deadLetters.Wait()
+
+	// The results are consumed by dispatch, so the producer is closed
+	// asynchronously and dispatch reports when it is done.
+	wk.producer.AsyncClose()
+	<-wk.dispatched
+
+	if cerr := wk.client.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 // Stop will stop Kawka processing data from websockets.
+// It is like Shutdown with no deadline.
 func (wk *Kawka) Stop() error {
-	if err := wk.producer.Close(); err != nil {
-		return err
+	return wk.Shutdown(context.Background())
+}
+
+func (wk *Kawka) isClosing() bool {
+	wk.mu.Lock()
+	defer wk.mu.Unlock()
+	return wk.closing
+}
+
+// trackConn registers c as a live connection.
+// It returns false if Kawka is shutting down and c must not be served.
+func (wk *Kawka) trackConn(c *conn) bool {
+	wk.mu.Lock()
+	defer wk.mu.Unlock()
+
+	if wk.closing {
+		return false
+	}
+	wk.conns[c] = struct{}{}
+	wk.metrics.connections.Update(int64(len(wk.conns)))
+	wk.acquireLimits(c)
+	wk.wg.Add(1)
+	return true
+}
+
+// acquireSlot reserves a connection slot for a client from ip.
+// It returns an error if the connection limits are reached.
+func (wk *Kawka) acquireSlot(ip string) error {
+	wk.mu.Lock()
+	defer wk.mu.Unlock()
+
+	if wk.maxConns > 0 && wk.slots >= wk.maxConns {
+		wk.metrics.rejectedConns.Inc(1)
+		return errTooManyConns
+	}
+	if wk.maxConnsPerIP > 0 {
+		if wk.ipSlots[ip] >= wk.maxConnsPerIP {
+			wk.metrics.rejectedConns.Inc(1)
+			return errTooManyConnsPerIP
+		}
+		wk.ipSlots[ip]++
+	}
+	wk.slots++
+	return nil
+}
+
+func (wk *Kawka) releaseSlot(ip string) {
+	wk.mu.Lock()
+	defer wk.mu.Unlock()
+
+	wk.slots--
+	if wk.maxConnsPerIP > 0 {
+		if wk.ipSlots[ip]--; wk.ipSlots[ip] <= 0 {
+			delete(wk.ipSlots, ip)
+		}
+	}
+}
+
+func (wk *Kawka) untrackConn(c *conn) {
+	wk.mu.Lock()
+	wk.releaseLimits(c)
+	delete(wk.conns, c)
+	wk.metrics.connections.Update(int64(len(wk.conns)))
+	wk.mu.Unlock()
+
+	wk.wg.Done()
+}
+
+func (wk *Kawka) initTLS() error {
+	if wk.certs != nil {
+		wk.certs.logger = wk.logger
 	}
+	if wk.clientCAs == nil {
+		return nil
+	}
+	if wk.tlsConfig == nil {
+		return errors.New("kawka: client certificates require TLS")
+	}
+	wk.tlsConfig.ClientCAs = wk.clientCAs
+	wk.tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 	return nil
 }
 
 func (wk *Kawka) initProducer(brokers []string) error {
-	config := kafka.NewConfig()
-	config.Version = kafka.V0_10_0_1
-	config.Producer.Partitioner = kafka.NewManualPartitioner
+	config := wk.config
+	config.Producer.Partitioner = newRecordPartitioner(wk.partitioner)
 	config.Producer.Return.Successes = true
+	config.Producer.Return.Errors = true
+	if wk.maxInFlight > 0 {
+		// Retries must not reorder the records of a partition.
+		config.Net.MaxOpenRequests = 1
+	}
+
+	if err := config.Validate(); err != nil {
+		return err
+	}
+
+	wk.logger.Info("connecting to kafka", "brokers", strings.Join(brokers, ","), "version", config.Version.String(), "async", wk.maxInFlight > 0)
 
 	var err error
-	wk.producer, err = kafka.NewSyncProducer(brokers, config)
+	wk.client, err = kafka.NewClient(brokers, config)
 	if err != nil {
 		return err
 	}
-	return nil
-}
 
-func defaultMessageHandler(data []byte) (topic string, content []byte, err error) {
-	var msg *Message
-	if err := json.Unmarshal(data, msg); err != nil {
-		return "", nil, err
+	// The sync producer of sarama replaces the metadata of the messages,
+	// which the partitioners rely on, so the records are always produced
+	// with the async producer and the sync mode waits for each result.
+	wk.producer, err = kafka.NewAsyncProducerFromClient(wk.client)
+	if err != nil {
+		wk.client.Close()
+		return err
 	}
-	return msg.Type, data, nil
+
+	wk.dispatched = make(chan struct{})
+	go wk.dispatch()
+	return nil
 }
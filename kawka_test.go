@@ -0,0 +1,35 @@
+package kawka
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestNewKawkaHeaders(t *testing.T) {
+	withClientCAs := func(wk *Kawka) error {
+		wk.clientCAs = x509.NewCertPool()
+		return nil
+	}
+
+	for _, test := range []struct {
+		name string
+		opts []Option
+		ok   bool
+	}{
+		{"default", nil, true},
+		{"dead-letter topic", []Option{WithDeadLetterTopic("dlt")}, false},
+		{"dead-letter topic with 0.11", []Option{WithDeadLetterTopic("dlt"), WithKafkaVersion("0.11.0.0")}, true},
+		{"client certificates", []Option{withClientCAs}, false},
+		{"client certificates with 0.11", []Option{withClientCAs, WithKafkaVersion("0.11.0.0")}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := newKawka(test.opts)
+			if test.ok && err != nil {
+				t.Errorf("got %v, want Kawka created", err)
+			}
+			if !test.ok && err == nil {
+				t.Error("got Kawka created, want an error")
+			}
+		})
+	}
+}
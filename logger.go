@@ -0,0 +1,171 @@
+package kawka
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+
+	kafka "github.com/Shopify/sarama"
+)
+
+// Logger is a leveled structured logger. Every message comes with a list
+// of alternating keys and values, such as "conn", 1, "topic", "events".
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// Level is the severity of a log message.
+type Level int
+
+// Log levels, from the most verbose.
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	default:
+		return "Level(" + strconv.Itoa(int(l)) + ")"
+	}
+}
+
+// ParseLevel returns the Level named s.
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return LevelDebug, nil
+	case "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return 0, errors.New("kawka: unknown log level " + s)
+	}
+}
+
+// NewLogger returns a Logger writing the messages of level and above to w
+// in the logfmt format, for example:
+//
+//	2018/03/01 12:00:00 level=error msg="error on produce" conn=1 topic=events err="..."
+func NewLogger(w io.Writer, level Level) Logger {
+	return &stdLogger{
+		log:   log.New(w, "", log.LstdFlags),
+		level: level,
+	}
+}
+
+type stdLogger struct {
+	log   *log.Logger
+	level Level
+}
+
+func (l *stdLogger) Debug(msg string, keyvals ...interface{}) { l.output(LevelDebug, msg, keyvals) }
+func (l *stdLogger) Info(msg string, keyvals ...interface{})  { l.output(LevelInfo, msg, keyvals) }
+func (l *stdLogger) Warn(msg string, keyvals ...interface{})  { l.output(LevelWarn, msg, keyvals) }
+func (l *stdLogger) Error(msg string, keyvals ...interface{}) { l.output(LevelError, msg, keyvals) }
+
+func (l *stdLogger) output(level Level, msg string, keyvals []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("level=")
+	buf.WriteString(level.String())
+	buf.WriteString(" msg=")
+	writeValue(&buf, msg)
+
+	for i := 0; i < len(keyvals); i += 2 {
+		buf.WriteByte(' ')
+		buf.WriteString(fmt.Sprint(keyvals[i]))
+		buf.WriteByte('=')
+		if i+1 < len(keyvals) {
+			writeValue(&buf, keyvals[i+1])
+		} else {
+			buf.WriteString(`""`)
+		}
+	}
+	l.log.Output(3, buf.String())
+}
+
+// writeValue writes v, quoted if needed.
+func writeValue(buf *bytes.Buffer, v interface{}) {
+	var s string
+	switch v := v.(type) {
+	case error:
+		s = v.Error()
+	case fmt.Stringer:
+		s = v.String()
+	default:
+		s = fmt.Sprint(v)
+	}
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		s = strconv.Quote(s)
+	}
+	buf.WriteString(s)
+}
+
+// nopLogger discards all messages.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// SaramaLogger adapts l to the logger of sarama, which is set globally:
+//
+//	sarama.Logger = kawka.SaramaLogger(logger)
+//
+// The messages of sarama are logged at the debug level.
+func SaramaLogger(l Logger) kafka.StdLogger {
+	return saramaLogger{l}
+}
+
+type saramaLogger struct {
+	l Logger
+}
+
+func (s saramaLogger) Print(v ...interface{}) {
+	s.l.Debug(strings.TrimSuffix(fmt.Sprint(v...), "\n"), "component", "sarama")
+}
+
+func (s saramaLogger) Printf(format string, v ...interface{}) {
+	s.l.Debug(strings.TrimSuffix(fmt.Sprintf(format, v...), "\n"), "component", "sarama")
+}
+
+func (s saramaLogger) Println(v ...interface{}) {
+	s.l.Debug(strings.TrimSuffix(fmt.Sprintln(v...), "\n"), "component", "sarama")
+}
+
+// keyvals returns the log fields identifying p.
+func (p *Peer) keyvals(keyvals ...interface{}) []interface{} {
+	kv := []interface{}{"conn", p.ID}
+	if p.RemoteAddr != nil {
+		kv = append(kv, "remote", p.RemoteAddr.String())
+	}
+	if p.Subject != "" {
+		kv = append(kv, "subject", p.Subject)
+	}
+	return append(kv, keyvals...)
+}
@@ -0,0 +1,232 @@
+package kawka
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// kawkaMetrics are reported to the metric registry of sarama, so they are
+// exported together with the broker metrics.
+type kawkaMetrics struct {
+	registry metrics.Registry
+
+	connections      metrics.Gauge
+	frames           metrics.Counter
+	bytes            metrics.Counter
+	messages         metrics.Counter
+	handlerErrors    metrics.Counter
+	deadLetters      metrics.Counter
+	authFailures     metrics.Counter
+	accessDenied     metrics.Counter
+	originRejections metrics.Counter
+	rateLimited      metrics.Counter
+	rejectedConns    metrics.Counter
+	produceLatency   metrics.Histogram
+
+	mu     sync.Mutex
+	topics map[string]bool // topics with their own counters
+}
+
+func newMetrics(registry metrics.Registry) *kawkaMetrics {
+	return &kawkaMetrics{
+		registry:         registry,
+		connections:      metrics.GetOrRegisterGauge("active-connections", registry),
+		frames:           metrics.GetOrRegisterCounter("frames-received", registry),
+		bytes:            metrics.GetOrRegisterCounter("bytes-received", registry),
+		messages:         metrics.GetOrRegisterCounter("messages-received", registry),
+		handlerErrors:    metrics.GetOrRegisterCounter("handler-errors", registry),
+		deadLetters:      metrics.GetOrRegisterCounter("dead-letter-records", registry),
+		authFailures:     metrics.GetOrRegisterCounter("authentication-failures", registry),
+		accessDenied:     metrics.GetOrRegisterCounter("access-denied", registry),
+		originRejections: metrics.GetOrRegisterCounter("origin-rejections", registry),
+		rateLimited:      metrics.GetOrRegisterCounter("rate-limited-messages", registry),
+		rejectedConns:    metrics.GetOrRegisterCounter("rejected-connections", registry),
+		produceLatency: metrics.GetOrRegisterHistogram("produce-latency-in-ms", registry,
+			metrics.NewExpDecaySample(1028, 0.015)),
+		topics: make(map[string]bool),
+	}
+}
+
+// maxTopicMetrics limits the topics with their own counters, the topics
+// come from the clients and the counters are never removed.
+const maxTopicMetrics = 1000
+
+// otherTopics counts the topics without their own counters. It is not a
+// valid topic name.
+const otherTopics = "(other)"
+
+// topicCounter returns the counter name of topic, named like the topic
+// metrics of sarama. A topic gets its own counters once a record is
+// produced to it, until there are maxTopicMetrics of them.
+func (m *kawkaMetrics) topicCounter(name, topic string, produced bool) metrics.Counter {
+	m.mu.Lock()
+	if !m.topics[topic] {
+		if produced && len(m.topics) < maxTopicMetrics {
+			m.topics[topic] = true
+		} else {
+			topic = otherTopics
+		}
+	}
+	m.mu.Unlock()
+
+	name += topicSuffix + strings.Replace(topic, ".", "_", -1)
+	return metrics.GetOrRegisterCounter(name, m.registry)
+}
+
+// produced records the result of producing a record to topic.
+func (m *kawkaMetrics) produced(topic string, start time.Time, err error) {
+	if err != nil {
+		m.topicCounter("failed-records", topic, false).Inc(1)
+		return
+	}
+	m.topicCounter("produced-records", topic, true).Inc(1)
+	m.produceLatency.Update(int64(time.Since(start) / time.Millisecond))
+}
+
+// Suffixes of the per-broker and per-topic metric names of sarama. They
+// are exported as labels.
+const (
+	brokerSuffix = "-for-broker-"
+	topicSuffix  = "-for-topic-"
+)
+
+// metricsNamespace prefixes the names of the exported metrics.
+const metricsNamespace = "kawka_"
+
+var summaryQuantiles = []float64{0.5, 0.75, 0.95, 0.99, 0.999}
+
+// MetricsHandler returns an http.Handler serving the metrics of Kawka and
+// sarama in the Prometheus text format.
+func (wk *Kawka) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writePrometheus(w, wk.metrics.registry)
+	})
+}
+
+// sample is a single exported metric, a family member.
+type sample struct {
+	labels string
+	metric interface{}
+}
+
+// writePrometheus writes the metrics of registry in the Prometheus text
+// format. Histograms are exported as summaries, meters as counters of
+// their events.
+//
+// The summaries have no _sum: go-metrics only sums the sampled values,
+// which is not a counter and cannot be divided by _count.
+func writePrometheus(w io.Writer, registry metrics.Registry) {
+	families := make(map[string][]sample)
+	registry.Each(func(name string, metric interface{}) {
+		var labels string
+		for _, s := range []struct{ suffix, label string }{
+			{brokerSuffix, "broker"},
+			{topicSuffix, "topic"},
+		} {
+			if i := strings.Index(name, s.suffix); i >= 0 {
+				labels = s.label + `="` + escapeLabel(name[i+len(s.suffix):]) + `"`
+				name = name[:i]
+				break
+			}
+		}
+		name = metricName(name)
+		if _, ok := metric.(metrics.Meter); ok {
+			name += "_total"
+		}
+		families[name] = append(families[name], sample{labels, metric})
+	})
+
+	names := make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	bw := bufio.NewWriter(w)
+	defer bw.Flush()
+
+	for _, name := range names {
+		samples := families[name]
+		sort.Slice(samples, func(i, j int) bool { return samples[i].labels < samples[j].labels })
+
+		typ := metricType(samples[0].metric)
+		if typ == "" {
+			continue
+		}
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, typ)
+
+		for _, s := range samples {
+			switch m := s.metric.(type) {
+			case metrics.Counter:
+				writeSample(bw, name, s.labels, float64(m.Count()))
+			case metrics.Gauge:
+				writeSample(bw, name, s.labels, float64(m.Value()))
+			case metrics.GaugeFloat64:
+				writeSample(bw, name, s.labels, m.Value())
+			case metrics.Meter:
+				writeSample(bw, name, s.labels, float64(m.Count()))
+			case metrics.Histogram:
+				h := m.Snapshot()
+				for i, v := range h.Percentiles(summaryQuantiles) {
+					q := `quantile="` + strconv.FormatFloat(summaryQuantiles[i], 'g', -1, 64) + `"`
+					writeSample(bw, name, joinLabels(s.labels, q), v)
+				}
+				writeSample(bw, name+"_count", s.labels, float64(h.Count()))
+			}
+		}
+	}
+}
+
+// metricType returns the Prometheus type of metric, or an empty string if
+// it is not exported.
+func metricType(metric interface{}) string {
+	switch metric.(type) {
+	case metrics.Counter, metrics.Meter:
+		return "counter"
+	case metrics.Gauge, metrics.GaugeFloat64:
+		return "gauge"
+	case metrics.Histogram:
+		return "summary"
+	default:
+		return ""
+	}
+}
+
+func writeSample(w io.Writer, name, labels string, v float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s %s\n", name, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func joinLabels(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a + "," + b
+}
+
+// metricName converts a go-metrics name into a valid Prometheus one.
+func metricName(name string) string {
+	b := []byte(metricsNamespace + name)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == ':') {
+			b[i] = '_'
+		}
+	}
+	return string(b)
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
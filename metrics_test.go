@@ -0,0 +1,49 @@
+package kawka
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestTopicCounters(t *testing.T) {
+	registry := metrics.NewRegistry()
+	m := newMetrics(registry)
+
+	// Failures do not create the counters of a topic.
+	for i := 0; i < 10; i++ {
+		m.produced("random."+strconv.Itoa(i), time.Now(), errSpooled)
+	}
+	m.produced("events", time.Now(), nil)
+	m.produced("events", time.Now(), errSpooled)
+
+	var buf bytes.Buffer
+	writePrometheus(&buf, registry)
+	for _, want := range []string{
+		`kawka_failed_records{topic="(other)"} 10`,
+		`kawka_failed_records{topic="events"} 1`,
+		`kawka_produced_records{topic="events"} 1`,
+	} {
+		if !strings.Contains(buf.String(), want+"\n") {
+			t.Errorf("got no %s in\n%s", want, buf.String())
+		}
+	}
+	if strings.Contains(buf.String(), "random") {
+		t.Errorf("got the counters of the failed topics in\n%s", buf.String())
+	}
+
+	// The topics past the limit share the counters.
+	for i := 0; i < maxTopicMetrics; i++ {
+		m.produced("topic."+strconv.Itoa(i), time.Now(), nil)
+	}
+	if len(m.topics) != maxTopicMetrics {
+		t.Errorf("got %d topics with counters, want %d", len(m.topics), maxTopicMetrics)
+	}
+	if c := m.topicCounter("produced-records", "new", true); c.Count() != 1 {
+		t.Errorf("got %d records of the other topics, want 1", c.Count())
+	}
+}
@@ -1,5 +1,13 @@
 package kawka
 
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+
+	kafka "github.com/Shopify/sarama"
+)
+
 // Option ...
 type Option func(*Kawka) error
 
@@ -13,6 +21,20 @@ func WithBrokers(brokers []string) Option {
 
 // WithHandler ...
 func WithHandler(handler MessageHandler) Option {
+	return func(wk *Kawka) error {
+		if handler == nil {
+			wk.handler = nil
+			return nil
+		}
+		wk.handler = recordHandler(handler)
+		return nil
+	}
+}
+
+// WithRecordHandler sets a handler that controls the key, partition,
+// headers and timestamp of the records, or produces several records for
+// one message.
+func WithRecordHandler(handler RecordHandler) Option {
 	return func(wk *Kawka) error {
 		wk.handler = handler
 		return nil
@@ -27,9 +49,416 @@ func WithPort(port int) Option {
 	}
 }
 
-// WithTSL ...
+// WithAddr sets the TCP address Start listens on, such as "127.0.0.1:8080".
+// It takes precedence over WithPort.
+func WithAddr(addr string) Option {
+	return func(wk *Kawka) error {
+		wk.addr = addr
+		return nil
+	}
+}
+
+// WithTSL makes Kawka serve wss:// with the given key pair.
+// The files are reloaded when they change on disk.
 func WithTSL(certFile, keyFile string) Option {
 	return func(wk *Kawka) error {
+		reloader, err := newCertReloader(certFile, keyFile)
+		if err != nil {
+			return err
+		}
+		wk.certs = reloader
+		wk.tlsConfig = &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+		}
+		return nil
+	}
+}
+
+// WithClientCA requires clients to present a certificate signed by one of
+// the CAs from caFile. It must be used together with WithTSL.
+//
+// The verified certificate subject is available as Peer.Subject and is
+// sent in the record headers, which requires Kafka version 0.11 or later.
+func WithClientCA(caFile string) Option {
+	return func(wk *Kawka) error {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return err
+		}
+		wk.clientCAs = pool
+		return nil
+	}
+}
+
+// WithAuthorizer sets a function that decides which topics a peer can access.
+func WithAuthorizer(authorizer Authorizer) Option {
+	return func(wk *Kawka) error {
+		wk.authorizer = authorizer
+		return nil
+	}
+}
+
+// WithOrigins makes Kawka reject with 403 Forbidden the handshakes from
+// the origins not allowed by cfg.
+func WithOrigins(cfg OriginConfig) Option {
+	return func(wk *Kawka) error {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		wk.origins = &cfg
+		return nil
+	}
+}
+
+// WithAuthenticator sets a function that authenticates the clients during
+// the WebSocket handshake.
+func WithAuthenticator(authenticator Authenticator) Option {
+	return func(wk *Kawka) error {
+		wk.authenticator = authenticator
+		return nil
+	}
+}
+
+// WithJWT requires the clients to present a JSON Web Token, either as the
+// bearer token of the Authorization header or as a query parameter.
+// See NewJWTAuthenticator.
+func WithJWT(cfg JWTConfig) Option {
+	return func(wk *Kawka) error {
+		authenticator, err := NewJWTAuthenticator(cfg)
+		if err != nil {
+			return err
+		}
+		wk.authenticator = authenticator
+		return nil
+	}
+}
+
+// WithPolicy enforces the access control policy loaded from the JSON file
+// name, see Policy. It is checked before the Authorizer, if any.
+func WithPolicy(name string) Option {
+	return func(wk *Kawka) error {
+		policy, err := LoadPolicy(name)
+		if err != nil {
+			return err
+		}
+		wk.policy = policy
+		return nil
+	}
+}
+
+// WithRateLimit limits the rate of the messages of every connection and
+// of every remote IP.
+func WithRateLimit(cfg RateLimitConfig) Option {
+	return func(wk *Kawka) error {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		wk.rateLimit = &cfg
+		wk.ipLimits = nil
+		if cfg.IP.Messages > 0 || cfg.IP.Bytes > 0 {
+			wk.ipLimits = newIPLimiters(cfg.IP)
+		}
+		return nil
+	}
+}
+
+// WithDeflate enables the permessage-deflate extension (RFC 7692) for the
+// clients offering it during the handshake.
+func WithDeflate(cfg DeflateConfig) Option {
+	return func(wk *Kawka) error {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		wk.deflate = &cfg
+		return nil
+	}
+}
+
+// WithAcks makes Kawka reply to every message with an Ack when it is
+// produced to Kafka or with an ErrorReply otherwise.
+func WithAcks() Option {
+	return func(wk *Kawka) error {
+		wk.acks = true
+		return nil
+	}
+}
+
+// WithSubscriptions lets clients subscribe to Kafka topics with a Command
+// and receive the records as Event frames.
+func WithSubscriptions() Option {
+	return func(wk *Kawka) error {
+		wk.subscriptions = true
+		return nil
+	}
+}
+
+// WithPartitioner sets the partitioning strategy for the records without an
+// explicit partition. Default is PartitionHash.
+func WithPartitioner(p Partitioner) Option {
+	return func(wk *Kawka) error {
+		constructor, err := p.constructor()
+		if err != nil {
+			return err
+		}
+		wk.partitioner = constructor
+		return nil
+	}
+}
+
+// WithCustomPartitioner sets a custom partitioner for the records without
+// an explicit partition.
+func WithCustomPartitioner(constructor kafka.PartitionerConstructor) Option {
+	return func(wk *Kawka) error {
+		if constructor == nil {
+			return errors.New("kawka: partitioner is nil")
+		}
+		wk.partitioner = constructor
+		return nil
+	}
+}
+
+// WithKafkaVersion sets the Kafka protocol version, like "0.11.0.2".
+// Default is 0.10.0.1.
+func WithKafkaVersion(version string) Option {
+	return func(wk *Kawka) error {
+		v, err := kafka.ParseKafkaVersion(version)
+		if err != nil {
+			return err
+		}
+		wk.config.Version = v
+		return nil
+	}
+}
+
+// WithRequiredAcks sets the level of acknowledgement reliability needed
+// from the brokers. Default is kafka.WaitForLocal.
+func WithRequiredAcks(acks kafka.RequiredAcks) Option {
+	return func(wk *Kawka) error {
+		wk.config.Producer.RequiredAcks = acks
+		return nil
+	}
+}
+
+// WithProducerTimeout sets how long the brokers wait for the required acks.
+func WithProducerTimeout(timeout time.Duration) Option {
+	return func(wk *Kawka) error {
+		wk.config.Producer.Timeout = timeout
+		return nil
+	}
+}
+
+// WithRetries sets how many times a message is retried and the backoff
+// between the retries.
+func WithRetries(max int, backoff time.Duration) Option {
+	return func(wk *Kawka) error {
+		wk.config.Producer.Retry.Max = max
+		wk.config.Producer.Retry.Backoff = backoff
+		return nil
+	}
+}
+
+// WithMaxMessageBytes sets the maximum size of a produced message.
+func WithMaxMessageBytes(n int) Option {
+	return func(wk *Kawka) error {
+		wk.config.Producer.MaxMessageBytes = n
+		return nil
+	}
+}
+
+// WithFlushFrequency sets how often the buffered messages are flushed.
+func WithFlushFrequency(frequency time.Duration) Option {
+	return func(wk *Kawka) error {
+		wk.config.Producer.Flush.Frequency = frequency
+		return nil
+	}
+}
+
+// WithCompression sets the compression codec of the produced messages.
+func WithCompression(codec kafka.CompressionCodec) Option {
+	return func(wk *Kawka) error {
+		wk.config.Producer.Compression = codec
+		return nil
+	}
+}
+
+// WithSaramaConfig replaces the whole sarama configuration with a copy of
+// config. Kawka still enforces the settings it depends on, such as
+// Producer.Return.Successes, and the result is validated in New.
+//
+// The options changing the configuration must follow WithSaramaConfig.
+func WithSaramaConfig(config *kafka.Config) Option {
+	return func(wk *Kawka) error {
+		if config == nil {
+			return errors.New("kawka: sarama config is nil")
+		}
+		c := *config
+		wk.config = &c
+		if c.Producer.Partitioner != nil {
+			wk.partitioner = c.Producer.Partitioner
+		}
+		return nil
+	}
+}
+
+// WithSASLPlain authenticates to the brokers with SASL/PLAIN.
+// The credentials are used by both the producer and the consumer.
+//
+// SASL/SCRAM is not supported by the sarama version Kawka is built with.
+func WithSASLPlain(user, password string) Option {
+	return func(wk *Kawka) error {
+		if user == "" {
+			return errors.New("kawka: SASL user is empty")
+		}
+		wk.config.Net.SASL.Enable = true
+		wk.config.Net.SASL.Handshake = true
+		wk.config.Net.SASL.User = user
+		wk.config.Net.SASL.Password = password
+		return nil
+	}
+}
+
+// WithKafkaTLS makes Kawka connect to the brokers over TLS.
+func WithKafkaTLS(cfg KafkaTLS) Option {
+	return func(wk *Kawka) error {
+		config, err := cfg.tlsConfig()
+		if err != nil {
+			return err
+		}
+		wk.config.Net.TLS.Enable = true
+		wk.config.Net.TLS.Config = config
+		return nil
+	}
+}
+
+// WithAsyncProducer makes Kawka produce through an async producer, which
+// batches the records of all the connections. Every connection may have at
+// most maxInFlight records being produced, its reads are paused once the
+// limit is reached. The acks are still sent in the order of the messages.
+func WithAsyncProducer(maxInFlight int) Option {
+	return func(wk *Kawka) error {
+		if maxInFlight < 1 {
+			return errors.New("kawka: max in-flight records must be positive")
+		}
+		wk.maxInFlight = maxInFlight
+		return nil
+	}
+}
+
+// WithDeadLetterTopic makes Kawka produce the messages rejected by the
+// handler or the authorizer and the records failed to be produced to the
+// topic, along with the headers describing the failure. The headers
+// require Kafka 0.11.0.0 or later, see WithKafkaVersion.
+func WithDeadLetterTopic(topic string) Option {
+	return func(wk *Kawka) error {
+		wk.deadLetterTopic = topic
+		return nil
+	}
+}
+
+// WithSpool makes Kawka save the records it fails to produce while Kafka
+// is unavailable to a local disk spool and replay them in order once
+// Kafka recovers. The records are replayed at least once. Until the spooled
+// records of a topic are replayed, the new records of the topic are
+// spooled behind them.
+func WithSpool(cfg SpoolConfig) Option {
+	return func(wk *Kawka) error {
+		if err := cfg.validate(); err != nil {
+			return err
+		}
+		wk.spoolConfig = &cfg
+		return nil
+	}
+}
+
+// WithMetricsAddr makes Start serve the metrics of Kawka and sarama in the
+// Prometheus text format on addr at /metrics, along with the liveness and
+// readiness probes at /healthz and /readyz.
+func WithMetricsAddr(addr string) Option {
+	return func(wk *Kawka) error {
+		wk.metricsAddr = addr
+		return nil
+	}
+}
+
+// WithLogger sets the logger of Kawka. By default the messages of the info
+// level and above are written to stderr. A nil logger discards them.
+func WithLogger(logger Logger) Option {
+	return func(wk *Kawka) error {
+		if logger == nil {
+			logger = nopLogger{}
+		}
+		wk.logger = logger
+		return nil
+	}
+}
+
+// WithMaxConnections limits the number of the concurrent connections.
+// The connections over the limit are closed before the handshake, or
+// answered with 503 Service Unavailable by ServeHTTP.
+func WithMaxConnections(n int) Option {
+	return func(wk *Kawka) error {
+		if n < 0 {
+			return errors.New("kawka: max connections must not be negative")
+		}
+		wk.maxConns = n
+		return nil
+	}
+}
+
+// WithMaxConnectionsPerIP limits the number of the concurrent connections
+// from the same remote IP.
+func WithMaxConnectionsPerIP(n int) Option {
+	return func(wk *Kawka) error {
+		if n < 0 {
+			return errors.New("kawka: max connections per IP must not be negative")
+		}
+		wk.maxConnsPerIP = n
+		return nil
+	}
+}
+
+// WithHandshakeTimeout sets how long a client accepted by Start has to
+// complete the TLS and WebSocket handshakes. Zero disables the timeout.
+// Default is 10 seconds. The handshakes served by ServeHTTP are bound by
+// the timeouts of the http.Server instead.
+func WithHandshakeTimeout(timeout time.Duration) Option {
+	return func(wk *Kawka) error {
+		wk.handshakeTimeout = timeout
+		return nil
+	}
+}
+
+// WithMaxFrameSize limits the payload size of a client frame, the
+// connection is closed with status 1009 otherwise. Zero is unlimited,
+// which is the default, the message size limit still applies.
+func WithMaxFrameSize(n int64) Option {
+	return func(wk *Kawka) error {
+		if n < 0 {
+			return errors.New("kawka: max frame size must not be negative")
+		}
+		wk.maxFrameSize = n
+		return nil
+	}
+}
+
+// WithMaxMessageSize limits the size of a client message, after it is
+// reassembled from the frames and decompressed. The connection is closed
+// with status 1009 otherwise. Zero is unlimited. Default is 1MB.
+func WithMaxMessageSize(n int64) Option {
+	return func(wk *Kawka) error {
+		if n < 0 {
+			return errors.New("kawka: max message size must not be negative")
+		}
+		wk.maxMessageSize = n
+		return nil
+	}
+}
+
+// WithShutdownTimeout sets how long Start waits for in-flight messages
+// when its context is done. Default is 10 seconds.
+func WithShutdownTimeout(timeout time.Duration) Option {
+	return func(wk *Kawka) error {
+		wk.shutdownTimeout = timeout
 		return nil
 	}
 }
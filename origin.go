@@ -0,0 +1,92 @@
+package kawka
+
+import (
+	"errors"
+	"strings"
+)
+
+// errForbiddenOrigin is sent to the clients whose Origin is not allowed.
+var errForbiddenOrigin = errors.New("kawka: origin not allowed")
+
+// OriginConfig restricts the web pages allowed to connect to Kawka, which
+// protects browser users from cross-site WebSocket hijacking.
+type OriginConfig struct {
+	// Allowed lists the allowed origins. A pattern is either a full
+	// origin, like "https://example.com", or a host matching any scheme,
+	// like "example.com". A "*." prefix matches any subdomain, so
+	// "https://*.example.com" allows "https://app.example.com" but not
+	// "https://example.com".
+	Allowed []string
+
+	// AllowMissing lets in the requests without an Origin header. Browsers
+	// always send it, so these come from other clients.
+	AllowMissing bool
+}
+
+func (cfg *OriginConfig) validate() error {
+	for _, pattern := range cfg.Allowed {
+		if _, _, err := parseOrigin(pattern, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// allow reports whether origin, the value of an Origin header, is allowed.
+func (cfg *OriginConfig) allow(origin string) bool {
+	if origin == "" {
+		return cfg.AllowMissing
+	}
+	scheme, host, err := parseOrigin(origin, false)
+	if err != nil {
+		return false
+	}
+
+	for _, pattern := range cfg.Allowed {
+		ps, ph, _ := parseOrigin(pattern, true)
+		if ps != "" && ps != scheme {
+			continue
+		}
+		if ph == host {
+			return true
+		}
+		if strings.HasPrefix(ph, "*.") && strings.HasSuffix(host, ph[1:]) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseOrigin returns the lower case scheme and host of an origin, like
+// "https" and "example.com:8443". The scheme of a pattern is optional.
+func parseOrigin(s string, pattern bool) (scheme, host string, err error) {
+	host = strings.ToLower(strings.TrimSpace(s))
+	if i := strings.Index(host, "://"); i >= 0 {
+		scheme, host = host[:i], host[i+3:]
+		if scheme == "" {
+			return "", "", errors.New("kawka: bad origin " + s)
+		}
+	} else if !pattern {
+		return "", "", errors.New("kawka: bad origin " + s)
+	}
+	host = strings.TrimSuffix(host, "/")
+
+	name := host
+	if pattern {
+		name = strings.TrimPrefix(host, "*.")
+	}
+	if name == "" || strings.ContainsAny(name, "/?#@*") {
+		return "", "", errors.New("kawka: bad origin " + s)
+	}
+	return scheme, host, nil
+}
+
+// checkOrigin returns an error if origin is not allowed.
+func (wk *Kawka) checkOrigin(origin, remote string) error {
+	if wk.origins == nil || wk.origins.allow(origin) {
+		return nil
+	}
+	wk.metrics.originRejections.Inc(1)
+	wk.logger.Warn("origin not allowed", "remote", remote, "origin", origin)
+	return errForbiddenOrigin
+}
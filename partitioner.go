@@ -0,0 +1,130 @@
+package kawka
+
+import (
+	"errors"
+	"hash/fnv"
+	"strconv"
+
+	kafka "github.com/Shopify/sarama"
+)
+
+// Partitioner is the strategy choosing partitions for the records without
+// an explicit partition.
+type Partitioner int
+
+// Partitioning strategies.
+const (
+	// PartitionHash chooses the partition by the record key,
+	// records without a key are distributed randomly.
+	PartitionHash Partitioner = iota
+
+	// PartitionRandom chooses a random partition.
+	PartitionRandom
+
+	// PartitionRoundRobin walks over the partitions in turn.
+	PartitionRoundRobin
+
+	// PartitionManual uses the partition set by the handler, or 0.
+	PartitionManual
+
+	// PartitionSticky sends all the records from one connection to the same
+	// partition, preserving per-client ordering without keys.
+	PartitionSticky
+)
+
+var partitionerNames = map[Partitioner]string{
+	PartitionHash:       "hash",
+	PartitionRandom:     "random",
+	PartitionRoundRobin: "roundrobin",
+	PartitionManual:     "manual",
+	PartitionSticky:     "sticky",
+}
+
+func (p Partitioner) String() string {
+	if name, ok := partitionerNames[p]; ok {
+		return name
+	}
+	return "Partitioner(" + strconv.Itoa(int(p)) + ")"
+}
+
+// ParsePartitioner returns the partitioner named by s, as returned by
+// Partitioner.String.
+func ParsePartitioner(s string) (Partitioner, error) {
+	for p, name := range partitionerNames {
+		if name == s {
+			return p, nil
+		}
+	}
+	return 0, errors.New("kawka: unknown partitioner " + s)
+}
+
+func (p Partitioner) constructor() (kafka.PartitionerConstructor, error) {
+	switch p {
+	case PartitionHash:
+		return kafka.NewHashPartitioner, nil
+	case PartitionRandom:
+		return kafka.NewRandomPartitioner, nil
+	case PartitionRoundRobin:
+		return kafka.NewRoundRobinPartitioner, nil
+	case PartitionManual:
+		return kafka.NewManualPartitioner, nil
+	case PartitionSticky:
+		return newStickyPartitioner, nil
+	default:
+		return nil, errors.New("kawka: unknown partitioner " + p.String())
+	}
+}
+
+// recordPartitioner sends records with an explicit partition to that
+// partition and uses the base partitioner for the rest.
+type recordPartitioner struct {
+	base kafka.Partitioner
+}
+
+func newRecordPartitioner(base kafka.PartitionerConstructor) kafka.PartitionerConstructor {
+	return func(topic string) kafka.Partitioner {
+		return &recordPartitioner{base: base(topic)}
+	}
+}
+
+func (p *recordPartitioner) Partition(msg *kafka.ProducerMessage, numPartitions int32) (int32, error) {
+	if env, ok := msg.Metadata.(*envelope); ok && env.rec != nil && env.rec.Partition != nil {
+		if *env.rec.Partition < 0 || *env.rec.Partition >= numPartitions {
+			return -1, kafka.ErrInvalidPartition
+		}
+		return *env.rec.Partition, nil
+	}
+	return p.base.Partition(msg, numPartitions)
+}
+
+func (p *recordPartitioner) RequiresConsistency() bool {
+	return p.base.RequiresConsistency()
+}
+
+// stickyPartitioner chooses the partition by the connection of a record.
+type stickyPartitioner struct {
+	fallback kafka.Partitioner
+}
+
+func newStickyPartitioner(topic string) kafka.Partitioner {
+	return &stickyPartitioner{fallback: kafka.NewHashPartitioner(topic)}
+}
+
+func (p *stickyPartitioner) Partition(msg *kafka.ProducerMessage, numPartitions int32) (int32, error) {
+	env, ok := msg.Metadata.(*envelope)
+	if !ok || env.peer == nil {
+		return p.fallback.Partition(msg, numPartitions)
+	}
+
+	h := fnv.New32a()
+	var b [8]byte
+	for i := range b {
+		b[i] = byte(env.peer.ID >> (8 * uint(i)))
+	}
+	h.Write(b[:])
+	return int32(h.Sum32() % uint32(numPartitions)), nil
+}
+
+func (p *stickyPartitioner) RequiresConsistency() bool {
+	return true
+}
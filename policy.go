@@ -0,0 +1,218 @@
+package kawka
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+)
+
+// AnyPrincipal names the rules of a Policy applying to every peer,
+// authenticated or not.
+const AnyPrincipal = "*"
+
+// Policy is a declarative access control policy, usually loaded from a
+// JSON file with LoadPolicy:
+//
+//	{
+//	  "roles": {
+//	    "writer": [{"topics": ["events.*"], "types": ["click", "view"], "produce": true}],
+//	    "reader": [{"topics": ["events.*", "audit"], "subscribe": true}]
+//	  },
+//	  "roles_claim": "roles",
+//	  "principals": {
+//	    "alice": {"roles": ["writer", "reader"]},
+//	    "*": {"rules": [{"topics": ["public"], "subscribe": true}]}
+//	  },
+//	  "certificates": {
+//	    "CN=billing": {"rules": [{"topics": ["billing"], "produce": true}]}
+//	  }
+//	}
+//
+// The principals are named by the sub claim of their token and the
+// certificates by the subject of the client certificate, so a token can
+// not pass for a certificate. A peer with both gets the rules of both.
+// An access is allowed if any rule of the principal, of the certificate,
+// of their roles or of AnyPrincipal allows it, everything else is denied.
+type Policy struct {
+	Roles map[string][]Rule `json:"roles"`
+
+	// RolesClaim names the claim of the token listing the roles of the
+	// peer, a string or a list of strings. The roles unknown to the
+	// policy are ignored. The roles are not taken from the tokens if it
+	// is empty.
+	RolesClaim string `json:"roles_claim"`
+
+	Principals   map[string]Principal `json:"principals"`
+	Certificates map[string]Principal `json:"certificates"`
+}
+
+// Principal lists the roles and the rules of a principal.
+type Principal struct {
+	Roles []string `json:"roles"`
+	Rules []Rule   `json:"rules"`
+}
+
+// Rule allows operations on a set of topics.
+//
+// The topics and the types are exact names or glob patterns, as in
+// path.Match, so "events.*" matches every topic prefixed with "events.".
+type Rule struct {
+	Topics []string `json:"topics"`
+
+	// Types restricts the values of Message.Type the peer can produce.
+	// The messages of any type are allowed if it is empty.
+	Types []string `json:"types"`
+
+	Produce   bool `json:"produce"`
+	Subscribe bool `json:"subscribe"`
+}
+
+// LoadPolicy reads the JSON policy from name.
+// Unknown fields are errors, so typos do not grant or deny access silently.
+func LoadPolicy(name string) (*Policy, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	var p Policy
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("kawka: policy %s: %v", name, err)
+	}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (p *Policy) validate() error {
+	check := func(rules []Rule) error {
+		for _, r := range rules {
+			for _, patterns := range [][]string{r.Topics, r.Types} {
+				for _, pattern := range patterns {
+					if _, err := path.Match(pattern, ""); err != nil {
+						return fmt.Errorf("kawka: bad policy pattern %q", pattern)
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	for name, rules := range p.Roles {
+		if err := check(rules); err != nil {
+			return fmt.Errorf("%v in role %s", err, name)
+		}
+	}
+	for kind, principals := range map[string]map[string]Principal{
+		"principal":   p.Principals,
+		"certificate": p.Certificates,
+	} {
+		for name, pr := range principals {
+			for _, role := range pr.Roles {
+				if _, ok := p.Roles[role]; !ok {
+					return fmt.Errorf("kawka: unknown role %s of %s %s", role, kind, name)
+				}
+			}
+			if err := check(pr.Rules); err != nil {
+				return fmt.Errorf("%v of %s %s", err, kind, name)
+			}
+		}
+	}
+	return nil
+}
+
+// Authorize reports whether peer is allowed the access.
+// It is an Authorizer.
+func (p *Policy) Authorize(peer *Peer, access Access) error {
+	principals := []Principal{p.Principals[AnyPrincipal]}
+	if sub, ok := peer.Claims["sub"].(string); ok && sub != "" {
+		principals = append(principals, p.Principals[sub])
+	}
+	if peer.Subject != "" {
+		principals = append(principals, p.Certificates[peer.Subject])
+	}
+	principals = append(principals, Principal{Roles: p.claimRoles(peer.Claims)})
+
+	for _, pr := range principals {
+		if allows(pr.Rules, access) {
+			return nil
+		}
+		for _, role := range pr.Roles {
+			if allows(p.Roles[role], access) {
+				return nil
+			}
+		}
+	}
+
+	if access.Op == OpProduce && access.Type != "" {
+		return fmt.Errorf("kawka: policy denies producing %s messages to %s", access.Type, access.Topic)
+	}
+	return errors.New("kawka: policy denies " + access.Op.String() + " to " + access.Topic)
+}
+
+// allows reports whether any of rules allows the access.
+func allows(rules []Rule, access Access) bool {
+	for _, r := range rules {
+		switch {
+		case access.Op == OpProduce && !r.Produce:
+			continue
+		case access.Op == OpSubscribe && !r.Subscribe:
+			continue
+		case !matchAny(r.Topics, access.Topic):
+			continue
+		case access.Op == OpProduce && len(r.Types) > 0 && !matchAny(r.Types, access.Type):
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern == name {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// claimRoles returns the roles listed by the RolesClaim of claims.
+func (p *Policy) claimRoles(claims Claims) []string {
+	if p.RolesClaim == "" {
+		return nil
+	}
+	switch v := claims[p.RolesClaim].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		roles := make([]string, 0, len(v))
+		for _, role := range v {
+			if s, ok := role.(string); ok {
+				roles = append(roles, s)
+			}
+		}
+		return roles
+	}
+	return nil
+}
+
+// messageType returns the type field of a JSON message, if any.
+func messageType(payload []byte) string {
+	var msg struct {
+		Type string `json:"type"`
+	}
+	if err := json.Unmarshal(payload, &msg); err != nil {
+		return ""
+	}
+	return msg.Type
+}
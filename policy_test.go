@@ -0,0 +1,84 @@
+package kawka
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+const testPolicy = `{
+  "roles": {
+    "writer": [{"topics": ["events.*"], "types": ["click"], "produce": true}],
+    "reader": [{"topics": ["events.*"], "subscribe": true}]
+  },
+  "roles_claim": "roles",
+  "principals": {
+    "alice": {"roles": ["writer"]},
+    "*": {"rules": [{"topics": ["public"], "subscribe": true}]}
+  },
+  "certificates": {
+    "CN=billing": {"rules": [{"topics": ["billing"], "produce": true}]}
+  }
+}`
+
+func TestPolicyAuthorize(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "policy.json")
+	if err := ioutil.WriteFile(name, []byte(testPolicy), 0600); err != nil {
+		t.Fatal(err)
+	}
+	p, err := LoadPolicy(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	click := Access{Op: OpProduce, Topic: "events.web", Type: "click"}
+	read := Access{Op: OpSubscribe, Topic: "events.web"}
+	billing := Access{Op: OpProduce, Topic: "billing"}
+
+	for _, test := range []struct {
+		name   string
+		peer   Peer
+		access Access
+		ok     bool
+	}{
+		{"anyone", Peer{}, Access{Op: OpSubscribe, Topic: "public"}, true},
+		{"anonymous", Peer{}, read, false},
+		{"principal", Peer{Claims: Claims{"sub": "alice"}}, click, true},
+		{"principal other type", Peer{Claims: Claims{"sub": "alice"}}, Access{Op: OpProduce, Topic: "events.web", Type: "view"}, false},
+		{"principal other op", Peer{Claims: Claims{"sub": "alice"}}, read, false},
+		{"certificate", Peer{Subject: "CN=billing"}, billing, true},
+		// A token can not pass for a certificate, nor the other way round.
+		{"token with certificate subject", Peer{Claims: Claims{"sub": "CN=billing"}}, billing, false},
+		{"certificate with principal name", Peer{Subject: "alice"}, click, false},
+		{"token and certificate", Peer{Claims: Claims{"sub": "alice"}, Subject: "CN=billing"}, billing, true},
+
+		{"claim role", Peer{Claims: Claims{"roles": "reader"}}, read, true},
+		{"claim roles", Peer{Claims: Claims{"roles": []interface{}{"admin", "reader"}}}, read, true},
+		{"claim roles and principal", Peer{Claims: Claims{"sub": "alice", "roles": []interface{}{"reader"}}}, read, true},
+		{"claim unknown role", Peer{Claims: Claims{"roles": []interface{}{"admin"}}}, read, false},
+		{"claim not a role", Peer{Claims: Claims{"roles": 1.0}}, read, false},
+		{"other claim", Peer{Claims: Claims{"groups": "reader"}}, read, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			err := p.Authorize(&test.peer, test.access)
+			if test.ok && err != nil {
+				t.Errorf("got %v, want the access allowed", err)
+			}
+			if !test.ok && err == nil {
+				t.Error("got the access allowed, want it denied")
+			}
+		})
+	}
+}
+
+func TestPolicyValidate(t *testing.T) {
+	for _, p := range []Policy{
+		{Principals: map[string]Principal{"alice": {Roles: []string{"nope"}}}},
+		{Certificates: map[string]Principal{"CN=billing": {Roles: []string{"nope"}}}},
+		{Certificates: map[string]Principal{"CN=billing": {Rules: []Rule{{Topics: []string{"["}}}}}},
+	} {
+		if err := p.validate(); err == nil {
+			t.Errorf("got %+v valid", p)
+		}
+	}
+}
@@ -0,0 +1,301 @@
+package kawka
+
+import (
+	"errors"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	websocket "github.com/gobwas/ws"
+)
+
+// errRateLimited is sent to the clients exceeding their rate limit.
+var errRateLimited = errors.New("kawka: rate limit exceeded")
+
+// RateAction is what Kawka does with a message exceeding the rate limit.
+type RateAction int
+
+// Actions on the messages exceeding the rate limit.
+const (
+	// RateDelay stops reading from the client until the message fits the
+	// limit, so TCP backpressure slows the client down.
+	RateDelay RateAction = iota
+
+	// RateReject drops the message and replies with an error.
+	RateReject
+
+	// RateClose closes the connection with the policy violation status.
+	RateClose
+)
+
+func (a RateAction) String() string {
+	switch a {
+	case RateDelay:
+		return "delay"
+	case RateReject:
+		return "reject"
+	case RateClose:
+		return "close"
+	default:
+		return "RateAction(" + strconv.Itoa(int(a)) + ")"
+	}
+}
+
+// ParseRateAction returns the RateAction named s.
+func ParseRateAction(s string) (RateAction, error) {
+	switch strings.ToLower(s) {
+	case "delay":
+		return RateDelay, nil
+	case "reject":
+		return RateReject, nil
+	case "close":
+		return RateClose, nil
+	default:
+		return 0, errors.New("kawka: unknown rate limit action " + s)
+	}
+}
+
+// RateLimit is the rate of the messages a client may send.
+// Zero rates are unlimited.
+type RateLimit struct {
+	Messages float64 // messages per second
+	Bytes    float64 // message bytes per second
+
+	// Burst is how many seconds worth of the rates may be sent at once.
+	// Default is one second.
+	Burst float64
+}
+
+func (l RateLimit) validate() error {
+	if l.Messages < 0 || l.Bytes < 0 || l.Burst < 0 {
+		return errors.New("kawka: rate limit must not be negative")
+	}
+	return nil
+}
+
+func (l RateLimit) limiter() *limiter {
+	if l.Messages == 0 && l.Bytes == 0 {
+		return nil
+	}
+	burst := l.Burst
+	if burst == 0 {
+		burst = 1
+	}
+	return &limiter{
+		messages: newBucket(l.Messages, burst),
+		bytes:    newBucket(l.Bytes, burst),
+	}
+}
+
+// RateLimitConfig limits the messages of the clients, the commands of
+// the subscriptions included. The size of a message is counted after it
+// is decompressed.
+type RateLimitConfig struct {
+	// Conn limits every connection.
+	Conn RateLimit
+
+	// IP limits all the connections from the same remote IP together.
+	IP RateLimit
+
+	// Action is what happens to the messages exceeding the limits.
+	// Default is RateDelay.
+	Action RateAction
+}
+
+func (cfg *RateLimitConfig) validate() error {
+	if err := cfg.Conn.validate(); err != nil {
+		return err
+	}
+	if err := cfg.IP.validate(); err != nil {
+		return err
+	}
+	if cfg.Action < RateDelay || cfg.Action > RateClose {
+		return errors.New("kawka: unknown rate limit action " + cfg.Action.String())
+	}
+	return nil
+}
+
+// bucket is a token bucket.
+type bucket struct {
+	mu     sync.Mutex
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newBucket returns a bucket refilled with rate tokens per second holding
+// at most burst seconds worth of them. A zero rate is unlimited, which is
+// a nil bucket.
+func newBucket(rate, burst float64) *bucket {
+	if rate == 0 {
+		return nil
+	}
+	b := &bucket{rate: rate, burst: rate * burst, last: time.Now()}
+	b.tokens = b.burst
+	return b
+}
+
+// wait returns how long until n tokens are available.
+// A request larger than the bucket needs the bucket to be full.
+func (b *bucket) wait(n float64, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+	need := math.Min(n, b.burst)
+	if b.tokens >= need {
+		return 0
+	}
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+// take removes n tokens, the bucket may go into debt.
+func (b *bucket) take(n float64) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.tokens -= n
+	b.mu.Unlock()
+}
+
+// limiter limits both the messages and the bytes.
+type limiter struct {
+	messages *bucket
+	bytes    *bucket
+}
+
+// ipLimiters hold the shared limiters of the remote IPs with live
+// connections.
+type ipLimiters struct {
+	limit RateLimit
+
+	mu   sync.Mutex
+	refs map[string]int
+	m    map[string]*limiter
+}
+
+func newIPLimiters(limit RateLimit) *ipLimiters {
+	return &ipLimiters{
+		limit: limit,
+		refs:  make(map[string]int),
+		m:     make(map[string]*limiter),
+	}
+}
+
+func (l *ipLimiters) acquire(ip string) *limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	lim, ok := l.m[ip]
+	if !ok {
+		lim = l.limit.limiter()
+		l.m[ip] = lim
+	}
+	l.refs[ip]++
+	return lim
+}
+
+func (l *ipLimiters) release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.refs[ip]--; l.refs[ip] <= 0 {
+		delete(l.refs, ip)
+		delete(l.m, ip)
+	}
+}
+
+// remoteIP returns the IP of the network address addr without the port.
+func remoteIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// acquireLimits sets up the rate limits of c.
+func (wk *Kawka) acquireLimits(c *conn) {
+	if wk.rateLimit == nil {
+		return
+	}
+	if lim := wk.rateLimit.Conn.limiter(); lim != nil {
+		c.limits = append(c.limits, lim)
+	}
+	if wk.ipLimits != nil {
+		if c.peer.RemoteAddr != nil {
+			c.ip = remoteIP(c.peer.RemoteAddr.String())
+		}
+		c.limits = append(c.limits, wk.ipLimits.acquire(c.ip))
+	}
+}
+
+func (wk *Kawka) releaseLimits(c *conn) {
+	if wk.ipLimits != nil {
+		wk.ipLimits.release(c.ip)
+	}
+}
+
+// throttle applies the rate limits of c to a message of size n.
+// It returns false if the message must be dropped, and a closeError if
+// the connection must be closed.
+func (wk *Kawka) throttle(c *conn, n int) (bool, error) {
+	if len(c.limits) == 0 {
+		return true, nil
+	}
+
+	limited := false
+	for {
+		var wait time.Duration
+		now := time.Now()
+		for _, lim := range c.limits {
+			if d := lim.messages.wait(1, now); d > wait {
+				wait = d
+			}
+			if d := lim.bytes.wait(float64(n), now); d > wait {
+				wait = d
+			}
+		}
+		if wait == 0 {
+			break
+		}
+
+		if !limited {
+			limited = true
+			wk.metrics.rateLimited.Inc(1)
+		}
+		switch wk.rateLimit.Action {
+		case RateReject:
+			return false, nil
+		case RateClose:
+			wk.logger.Warn("rate limit exceeded", c.peer.keyvals()...)
+			return false, closeError{websocket.StatusPolicyViolation, errRateLimited.Error()}
+		}
+
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-c.quit:
+			// The messages already read are processed on shutdown.
+			t.Stop()
+			return true, nil
+		}
+	}
+
+	for _, lim := range c.limits {
+		lim.messages.take(1)
+		lim.bytes.take(float64(n))
+	}
+	return true, nil
+}
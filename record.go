@@ -0,0 +1,113 @@
+package kawka
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	kafka "github.com/Shopify/sarama"
+)
+
+// errHeadersUnsupported is returned for the records with headers when the
+// Kafka version would drop them.
+var errHeadersUnsupported = errors.New("kawka: record headers require Kafka version 0.11.0.0 or later")
+
+// Record describes a Kafka record produced for a client message.
+type Record struct {
+	// ID is sent back in the ack of the record.
+	// If empty, the id field of the client message is used.
+	ID string
+
+	Topic string
+	Key   []byte
+	Value []byte
+
+	// Partition is the partition to produce the record to.
+	// If nil, the partition is chosen by the partitioner.
+	Partition *int32
+
+	// Headers require Kafka version 0.11 or later, the records with
+	// headers are rejected with older versions.
+	Headers []Header
+
+	// Timestamp of the record. If zero, the current time is used.
+	Timestamp time.Time
+}
+
+// Header is a key-value pair attached to a Kafka record.
+type Header struct {
+	Key   string
+	Value []byte
+}
+
+// RecordHandler turns a client message into Kafka records.
+// Returning no records drops the message.
+type RecordHandler func(peer *Peer, data []byte) ([]*Record, error)
+
+// recordHandler adapts h to RecordHandler.
+func recordHandler(h MessageHandler) RecordHandler {
+	return func(peer *Peer, data []byte) ([]*Record, error) {
+		topic, content, err := h(data)
+		if err != nil {
+			return nil, err
+		}
+		return []*Record{{Topic: topic, Value: content}}, nil
+	}
+}
+
+// envelope is attached to the producer messages to keep their origin.
+type envelope struct {
+	peer *Peer
+	rec  *Record
+
+	// payload is the client message the record was made of.
+	payload []byte
+
+	// errc receives the result of a record produced synchronously.
+	errc chan error
+
+	// start is the time the record was sent to the producer.
+	start time.Time
+
+	// conn and seq are set for the records produced asynchronously.
+	conn *conn
+	seq  uint64
+}
+
+// message returns the producer message for the record of env.
+func (env *envelope) message() *kafka.ProducerMessage {
+	r := env.rec
+	env.start = time.Now()
+	msg := &kafka.ProducerMessage{
+		Topic:     r.Topic,
+		Value:     kafka.ByteEncoder(r.Value),
+		Headers:   peerHeaders(env.peer),
+		Timestamp: r.Timestamp,
+		Metadata:  env,
+	}
+	if r.Key != nil {
+		msg.Key = kafka.ByteEncoder(r.Key)
+	}
+	for _, h := range r.Headers {
+		msg.Headers = append(msg.Headers, kafka.RecordHeader{
+			Key:   []byte(h.Key),
+			Value: h.Value,
+		})
+	}
+	return msg
+}
+
+// headersSupported reports whether the Kafka version keeps the record
+// headers, the producer drops them silently before 0.11.
+func (wk *Kawka) headersSupported() bool {
+	return wk.config.Version.IsAtLeast(kafka.V0_11_0_0)
+}
+
+// defaultHandler produces a Message to the topic named by its type.
+func defaultHandler(peer *Peer, data []byte) ([]*Record, error) {
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return []*Record{{ID: msg.ID, Topic: msg.Type, Value: data}}, nil
+}
@@ -0,0 +1,745 @@
+package kawka
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	kafka "github.com/Shopify/sarama"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+// errSpoolFull is returned when a record does not fit into the spool.
+var errSpoolFull = errors.New("kawka: spool is full")
+
+// errSpooled is the result of a record spooled behind the records of its
+// topic instead of being produced.
+var errSpooled = errors.New("kawka: record is spooled")
+
+// SyncPolicy defines when the spool is flushed to stable storage.
+type SyncPolicy int
+
+// Sync policies of the spool.
+const (
+	// SyncInterval flushes the spool periodically.
+	SyncInterval SyncPolicy = iota
+
+	// SyncAlways flushes the spool after each record.
+	SyncAlways
+
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+func (p SyncPolicy) String() string {
+	switch p {
+	case SyncInterval:
+		return "interval"
+	case SyncAlways:
+		return "always"
+	case SyncNever:
+		return "never"
+	default:
+		return "SyncPolicy(" + fmt.Sprint(int(p)) + ")"
+	}
+}
+
+// ParseSyncPolicy returns the SyncPolicy named s.
+func ParseSyncPolicy(s string) (SyncPolicy, error) {
+	switch strings.ToLower(s) {
+	case "interval":
+		return SyncInterval, nil
+	case "always":
+		return SyncAlways, nil
+	case "never":
+		return SyncNever, nil
+	default:
+		return 0, errors.New("kawka: unknown sync policy " + s)
+	}
+}
+
+// SpoolConfig configures the local disk spool of the records that could
+// not be produced because Kafka was unavailable.
+type SpoolConfig struct {
+	// Dir is the directory of the spool segment files.
+	Dir string
+
+	// MaxBytes limits the size of the records waiting in the spool. The
+	// records not fitting into the spool are failed. Zero means 1GB.
+	MaxBytes int64
+
+	// SegmentBytes is the size at which a new segment file is started.
+	// Zero means 64MB.
+	SegmentBytes int64
+
+	// Sync is the policy of flushing the spool to stable storage.
+	Sync SyncPolicy
+
+	// SyncInterval is the period of flushing with SyncInterval.
+	// Zero means one second.
+	SyncInterval time.Duration
+
+	// RetryInterval is the pause of the replay after Kafka failed to take
+	// a spooled record. Zero means one second.
+	RetryInterval time.Duration
+}
+
+func (cfg *SpoolConfig) validate() error {
+	if cfg.Dir == "" {
+		return errors.New("kawka: spool directory is required")
+	}
+	if cfg.MaxBytes < 0 || cfg.SegmentBytes < 0 || cfg.SyncInterval < 0 || cfg.RetryInterval < 0 {
+		return errors.New("kawka: negative spool limits")
+	}
+	if cfg.Sync < SyncInterval || cfg.Sync > SyncNever {
+		return errors.New("kawka: invalid spool sync policy " + cfg.Sync.String())
+	}
+	if cfg.MaxBytes == 0 {
+		cfg.MaxBytes = 1 << 30
+	}
+	if cfg.SegmentBytes == 0 {
+		cfg.SegmentBytes = 64 << 20
+	}
+	if cfg.SegmentBytes > cfg.MaxBytes {
+		cfg.SegmentBytes = cfg.MaxBytes
+	}
+	if cfg.SyncInterval == 0 {
+		cfg.SyncInterval = time.Second
+	}
+	if cfg.RetryInterval == 0 {
+		cfg.RetryInterval = time.Second
+	}
+	return nil
+}
+
+// Spool files are named by the sequence number of the segment, the replay
+// position is kept in the cursor file.
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+
+	// recordHeaderLen is the size of the length and the CRC-32 of the
+	// data preceding each record in a segment.
+	recordHeaderLen = 8
+)
+
+// spooledRecord is a record kept in the spool, encoded as JSON.
+type spooledRecord struct {
+	PeerID    uint64    `json:"peer_id,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Topic     string    `json:"topic"`
+	Key       []byte    `json:"key,omitempty"`
+	Value     []byte    `json:"value,omitempty"`
+	Partition *int32    `json:"partition,omitempty"`
+	Headers   []Header  `json:"headers,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// envelope returns the envelope to produce sr with.
+func (sr *spooledRecord) envelope() *envelope {
+	return &envelope{
+		peer: &Peer{ID: sr.PeerID, Subject: sr.Subject},
+		rec: &Record{
+			Topic:     sr.Topic,
+			Key:       sr.Key,
+			Value:     sr.Value,
+			Partition: sr.Partition,
+			Headers:   sr.Headers,
+			Timestamp: sr.Timestamp,
+		},
+	}
+}
+
+// segment is a spool file.
+type segment struct {
+	id   uint64
+	size int64
+}
+
+// spool is a write-ahead log of records replayed to Kafka in order.
+type spool struct {
+	cfg    SpoolConfig
+	logger Logger
+
+	mu       sync.Mutex
+	segments []*segment // oldest first, records are appended to the last
+	w        *os.File
+	r        *os.File // reads the first segment
+	offset   int64    // replay position in the first segment
+	pending  int64    // length of the record being replayed
+	size     int64
+	records  int64
+	dirty    bool
+
+	// topics counts the records per topic, the record being replayed
+	// included. It may overcount after a corrupted segment is skipped,
+	// so it is reset whenever the spool is empty.
+	topics       map[string]int64
+	pendingTopic string
+
+	notify chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+
+	depth    metrics.Gauge
+	bytes    metrics.Gauge
+	appended metrics.Counter
+	replayed metrics.Counter
+}
+
+// openSpool opens the spool in cfg.Dir, recovering the records left by
+// a previous run. Torn or corrupted records are truncated.
+func openSpool(cfg SpoolConfig, registry metrics.Registry, logger Logger) (*spool, error) {
+	if err := os.MkdirAll(cfg.Dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &spool{
+		cfg:      cfg,
+		logger:   logger,
+		topics:   make(map[string]int64),
+		notify:   make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		depth:    metrics.GetOrRegisterGauge("spool-records", registry),
+		bytes:    metrics.GetOrRegisterGauge("spool-bytes", registry),
+		appended: metrics.GetOrRegisterCounter("spool-appended", registry),
+		replayed: metrics.GetOrRegisterCounter("spool-replayed", registry),
+	}
+
+	cursorID, cursorOffset := s.readCursor()
+
+	names, err := filepath.Glob(filepath.Join(cfg.Dir, "*"+segmentExt))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var id uint64
+		if _, err := fmt.Sscanf(filepath.Base(name), "%020d"+segmentExt, &id); err != nil {
+			continue
+		}
+		if id < cursorID {
+			os.Remove(name)
+			continue
+		}
+
+		var from int64
+		if id == cursorID {
+			from = cursorOffset
+		}
+		size, records, err := recoverSegment(name, from, s.topics, s.logger)
+		if err != nil {
+			s.closeFiles()
+			return nil, err
+		}
+		s.segments = append(s.segments, &segment{id: id, size: size})
+		s.size += size
+		s.records += records
+	}
+
+	if len(s.segments) > 0 && s.segments[0].id == cursorID && cursorOffset <= s.segments[0].size {
+		s.offset = cursorOffset
+		s.size -= cursorOffset
+	}
+	if len(s.segments) == 0 {
+		s.segments = append(s.segments, &segment{id: cursorID})
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if s.w, err = os.OpenFile(s.path(last.id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+	if s.r, err = os.Open(s.path(s.segments[0].id)); err != nil {
+		s.closeFiles()
+		return nil, err
+	}
+
+	s.updateGauges()
+	return s, nil
+}
+
+// recoverSegment validates the records of a segment file, truncating it
+// at the first invalid one. It returns the valid size of the segment and
+// the number of records from the offset from, which are also counted per
+// topic in topics.
+func recoverSegment(name string, from int64, topics map[string]int64, logger Logger) (size, records int64, err error) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	for {
+		// Only the topics of the records to replay are decoded.
+		var sr struct {
+			Topic string `json:"topic"`
+		}
+		var v interface{}
+		if size >= from {
+			v = &sr
+		}
+		n, err := readRecord(f, size, fi.Size(), v)
+		if err == io.EOF {
+			return size, records, nil
+		}
+		if err != nil {
+			logger.Warn("error in spool, truncating", "file", name, "offset", size, "err", err)
+			return size, records, f.Truncate(size)
+		}
+		if v != nil {
+			records++
+			topics[sr.Topic]++
+		}
+		size += n
+	}
+}
+
+// readRecord reads the record at off from r, decoding its data into v
+// unless v is nil. It returns the size of the record in the segment, which
+// ends at end.
+func readRecord(r io.ReaderAt, off, end int64, v interface{}) (int64, error) {
+	var header [recordHeaderLen]byte
+	if n, err := r.ReadAt(header[:], off); err != nil {
+		if err == io.EOF && n > 0 {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+
+	// The checksum does not cover the length, it is checked before the
+	// data is allocated.
+	length := binary.BigEndian.Uint32(header[:4])
+	if int64(length) > end-off-recordHeaderLen {
+		return 0, errors.New("record past the end of the segment")
+	}
+	data := make([]byte, length)
+	if _, err := r.ReadAt(data, off+recordHeaderLen); err != nil {
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		}
+		return 0, err
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:]) {
+		return 0, errors.New("checksum mismatch")
+	}
+	if v != nil {
+		if err := json.Unmarshal(data, v); err != nil {
+			return 0, err
+		}
+	}
+	return recordHeaderLen + int64(length), nil
+}
+
+func (s *spool) path(id uint64) string {
+	return filepath.Join(s.cfg.Dir, fmt.Sprintf("%020d"+segmentExt, id))
+}
+
+// readCursor returns the replay position saved by commit.
+func (s *spool) readCursor() (id uint64, offset int64) {
+	data, err := ioutil.ReadFile(filepath.Join(s.cfg.Dir, cursorFile))
+	if err != nil || len(data) != 16 {
+		return 0, 0
+	}
+	return binary.BigEndian.Uint64(data[:8]), int64(binary.BigEndian.Uint64(data[8:]))
+}
+
+// writeCursor saves the replay position. It is written in place and not
+// flushed, so a crash may replay some records again.
+func (s *spool) writeCursor() {
+	var data [16]byte
+	binary.BigEndian.PutUint64(data[:8], s.segments[0].id)
+	binary.BigEndian.PutUint64(data[8:], uint64(s.offset))
+	if err := ioutil.WriteFile(filepath.Join(s.cfg.Dir, cursorFile), data[:], 0600); err != nil {
+		s.logger.Error("error on spool cursor", "err", err)
+	}
+}
+
+// append adds sr to the end of the spool.
+func (s *spool) append(sr *spooledRecord) error {
+	_, err := s.add(sr, false)
+	return err
+}
+
+// appendBehind adds sr to the end of the spool if the spool holds records
+// of the same topic, so sr does not overtake them. It reports whether sr
+// was added.
+func (s *spool) appendBehind(sr *spooledRecord) (bool, error) {
+	if !s.holds(sr.Topic) {
+		return false, nil
+	}
+	return s.add(sr, true)
+}
+
+// holds reports whether the spool has records of topic.
+func (s *spool) holds(topic string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.topics[topic] > 0
+}
+
+func (s *spool) add(sr *spooledRecord, behind bool) (bool, error) {
+	data, err := json.Marshal(sr)
+	if err != nil {
+		return false, err
+	}
+	buf := make([]byte, recordHeaderLen+len(data))
+	binary.BigEndian.PutUint32(buf[:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.ChecksumIEEE(data))
+	copy(buf[recordHeaderLen:], data)
+	n := int64(len(buf))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if behind && s.topics[sr.Topic] == 0 {
+		return false, nil
+	}
+	if s.size+n > s.cfg.MaxBytes {
+		return false, errSpoolFull
+	}
+
+	last := s.segments[len(s.segments)-1]
+	if last.size > 0 && last.size+n > s.cfg.SegmentBytes {
+		if err := s.rotate(); err != nil {
+			return false, err
+		}
+		last = s.segments[len(s.segments)-1]
+	}
+
+	if _, err := s.w.Write(buf); err != nil {
+		// Drop the partial write, so the segment stays readable.
+		s.w.Truncate(last.size)
+		return false, err
+	}
+	if s.cfg.Sync == SyncAlways {
+		if err := s.w.Sync(); err != nil {
+			return false, err
+		}
+	} else {
+		s.dirty = true
+	}
+
+	last.size += n
+	s.size += n
+	s.records++
+	s.topics[sr.Topic]++
+	s.appended.Inc(1)
+	s.updateGauges()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return true, nil
+}
+
+// rotate starts a new segment.
+func (s *spool) rotate() error {
+	if s.cfg.Sync != SyncNever {
+		if err := s.w.Sync(); err != nil {
+			return err
+		}
+	}
+
+	id := s.segments[len(s.segments)-1].id + 1
+	w, err := os.OpenFile(s.path(id), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	s.w.Close()
+	s.w = w
+	s.dirty = false
+	s.segments = append(s.segments, &segment{id: id})
+	return nil
+}
+
+// next returns the oldest record of the spool, or nil if it is empty.
+// The record stays in the spool until commit.
+func (s *spool) next() (*spooledRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for {
+		first := s.segments[0]
+		if s.offset < first.size {
+			break
+		}
+		if len(s.segments) == 1 {
+			if len(s.topics) > 0 {
+				s.topics = make(map[string]int64)
+			}
+			return nil, nil
+		}
+		if err := s.dropFirst(); err != nil {
+			return nil, err
+		}
+	}
+
+	sr := new(spooledRecord)
+	n, err := readRecord(s.r, s.offset, s.segments[0].size, sr)
+	if err != nil {
+		// The record cannot be replayed, skip the rest of the segment.
+		s.logger.Error("error in spool, skipping segment", "segment", s.segments[0].id, "offset", s.offset, "err", err)
+		s.skip(s.segments[0].size - s.offset)
+		return nil, err
+	}
+	s.pending = n
+	s.pendingTopic = sr.Topic
+	return sr, nil
+}
+
+// commit removes the record returned by next from the spool.
+func (s *spool) commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.skip(s.pending)
+	s.pending = 0
+	if s.topics[s.pendingTopic]--; s.topics[s.pendingTopic] <= 0 {
+		delete(s.topics, s.pendingTopic)
+	}
+	s.replayed.Inc(1)
+	s.writeCursor()
+}
+
+func (s *spool) skip(n int64) {
+	s.offset += n
+	s.size -= n
+	if s.records > 0 {
+		s.records--
+	}
+	s.updateGauges()
+}
+
+// dropFirst removes the fully replayed first segment.
+func (s *spool) dropFirst() error {
+	first := s.segments[0]
+	r, err := os.Open(s.path(s.segments[1].id))
+	if err != nil {
+		return err
+	}
+	s.r.Close()
+	s.r = r
+	s.segments = s.segments[1:]
+	s.offset = 0
+	s.writeCursor()
+	return os.Remove(s.path(first.id))
+}
+
+func (s *spool) updateGauges() {
+	s.depth.Update(s.records)
+	s.bytes.Update(s.size)
+}
+
+// flush syncs the appended records according to the SyncInterval policy
+// until the spool is closed.
+func (s *spool) flush() {
+	t := time.NewTicker(s.cfg.SyncInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			s.mu.Lock()
+			if s.dirty {
+				if err := s.w.Sync(); err != nil {
+					s.logger.Error("error on spool sync", "err", err)
+				}
+				s.dirty = false
+			}
+			s.mu.Unlock()
+
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// close stops the replay and closes the spool files.
+func (s *spool) close() error {
+	close(s.stop)
+	<-s.done
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var err error
+	if s.cfg.Sync != SyncNever {
+		err = s.w.Sync()
+	}
+	if cerr := s.closeFiles(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *spool) closeFiles() error {
+	var err error
+	if s.w != nil {
+		err = s.w.Close()
+	}
+	if s.r != nil {
+		s.r.Close()
+	}
+	return err
+}
+
+// checkSpool returns an error if the spool directory cannot be used.
+// Unlike openSpool it changes nothing, the directory is created on Open.
+func (wk *Kawka) checkSpool() error {
+	if wk.spoolConfig == nil {
+		return nil
+	}
+	fi, err := os.Stat(wk.spoolConfig.Dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return errors.New("kawka: spool " + wk.spoolConfig.Dir + " is not a directory")
+	}
+	return nil
+}
+
+// initSpool opens the spool and starts replaying it.
+func (wk *Kawka) initSpool() error {
+	if wk.spoolConfig == nil {
+		return nil
+	}
+
+	s, err := openSpool(*wk.spoolConfig, wk.config.MetricRegistry, wk.logger)
+	if err != nil {
+		return err
+	}
+	wk.spool = s
+
+	if s.cfg.Sync == SyncInterval {
+		go s.flush()
+	}
+	go wk.replay()
+	return nil
+}
+
+// spoolRecord appends the record of env failed with err to the spool.
+// It returns false if the record was not spooled.
+func (wk *Kawka) spoolRecord(env *envelope, err error) bool {
+	if wk.spool == nil || !temporary(err) {
+		return false
+	}
+	if err := wk.spool.append(newSpooledRecord(env)); err != nil {
+		wk.logger.Error("error on spool", env.peer.keyvals("topic", env.rec.Topic, "err", err)...)
+		return false
+	}
+	return true
+}
+
+// spoolBehind appends the record of env to the spool if the spool holds
+// records of the same topic, so it is not produced before them.
+// It returns false if the record was not spooled.
+func (wk *Kawka) spoolBehind(env *envelope) bool {
+	if wk.spool == nil {
+		return false
+	}
+	ok, err := wk.spool.appendBehind(newSpooledRecord(env))
+	if err != nil {
+		wk.logger.Error("error on spool", env.peer.keyvals("topic", env.rec.Topic, "err", err)...)
+	}
+	return ok
+}
+
+func newSpooledRecord(env *envelope) *spooledRecord {
+	rec := env.rec
+	sr := &spooledRecord{
+		PeerID:    env.peer.ID,
+		Subject:   env.peer.Subject,
+		Topic:     rec.Topic,
+		Key:       rec.Key,
+		Value:     rec.Value,
+		Partition: rec.Partition,
+		Headers:   rec.Headers,
+		Timestamp: rec.Timestamp,
+	}
+	if sr.Timestamp.IsZero() {
+		sr.Timestamp = time.Now()
+	}
+	return sr
+}
+
+// replay produces the spooled records to Kafka in order until the spool
+// is closed. Records failed with temporary errors are retried, the rest
+// are sent to the dead-letter topic.
+func (wk *Kawka) replay() {
+	s := wk.spool
+	defer close(s.done)
+
+	for {
+		sr, err := s.next()
+		if err != nil {
+			select {
+			case <-time.After(s.cfg.RetryInterval):
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+		if sr == nil {
+			select {
+			case <-s.notify:
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+
+		env := sr.envelope()
+		_, _, err = wk.sendMessage(env)
+		if err != nil && temporary(err) {
+			select {
+			case <-time.After(s.cfg.RetryInterval):
+				continue
+			case <-s.stop:
+				return
+			}
+		}
+		if err != nil {
+			wk.logger.Error("error on spool replay", "topic", sr.Topic, "err", err)
+			wk.deadLetter(env.peer, sr.Value, sr.Topic, err)
+		}
+		s.commit()
+	}
+}
+
+// temporary reports whether err means Kafka is unavailable, so producing
+// the record could succeed later.
+func temporary(err error) bool {
+	switch err {
+	case kafka.ErrOutOfBrokers, kafka.ErrNotConnected, kafka.ErrShuttingDown,
+		kafka.ErrLeaderNotAvailable, kafka.ErrNotLeaderForPartition,
+		kafka.ErrRequestTimedOut, kafka.ErrBrokerNotAvailable,
+		kafka.ErrNetworkException, kafka.ErrNotEnoughReplicas,
+		kafka.ErrNotEnoughReplicasAfterAppend:
+		return true
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
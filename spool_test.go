@@ -0,0 +1,141 @@
+package kawka
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+func TestSpoolBehind(t *testing.T) {
+	cfg := SpoolConfig{Dir: t.TempDir()}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	logger := NewLogger(ioutil.Discard, LevelError)
+
+	s, err := openSpool(cfg, metrics.NewRegistry(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.appendBehind(&spooledRecord{Topic: "a"}); ok || err != nil {
+		t.Fatalf("got %v, %v, want nothing spooled behind an empty spool", ok, err)
+	}
+
+	for _, sr := range []*spooledRecord{
+		{Topic: "a", Value: []byte("1")},
+		{Topic: "b", Value: []byte("2")},
+	} {
+		if err := s.append(sr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ok, err := s.appendBehind(&spooledRecord{Topic: "a", Value: []byte("3")}); !ok || err != nil {
+		t.Fatalf("got %v, %v, want the record spooled behind its topic", ok, err)
+	}
+	if ok, _ := s.appendBehind(&spooledRecord{Topic: "c"}); ok {
+		t.Fatal("got the record spooled behind another topic")
+	}
+
+	if sr, err := s.next(); err != nil || string(sr.Value) != "1" {
+		t.Fatalf("got %v, %v, want record 1", sr, err)
+	}
+	s.commit()
+
+	// The replay is not running.
+	close(s.done)
+	s.close()
+
+	// The topics of the records left are recovered.
+	if s, err = openSpool(cfg, metrics.NewRegistry(), logger); err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		close(s.done)
+		s.close()
+	}()
+
+	for _, test := range []struct {
+		value string
+		held  []string // the topics held after the record is replayed
+	}{
+		{"2", []string{"a"}},
+		{"3", nil},
+	} {
+		sr, err := s.next()
+		if err != nil || sr == nil {
+			t.Fatalf("got %v, %v, want record %s", sr, err, test.value)
+		}
+		if string(sr.Value) != test.value {
+			t.Fatalf("got record %s, want %s", sr.Value, test.value)
+		}
+		// The topic is held until its record is replayed.
+		if !s.holds(sr.Topic) {
+			t.Errorf("got topic %s released while replaying record %s", sr.Topic, sr.Value)
+		}
+		s.commit()
+
+		if len(s.topics) != len(test.held) {
+			t.Errorf("got topics %v after record %s, want %v", s.topics, sr.Value, test.held)
+		}
+		for _, topic := range test.held {
+			if !s.holds(topic) {
+				t.Errorf("got topic %s released after record %s", topic, sr.Value)
+			}
+		}
+	}
+}
+
+func TestSpoolCorruptLength(t *testing.T) {
+	cfg := SpoolConfig{Dir: t.TempDir()}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	logger := NewLogger(ioutil.Discard, LevelError)
+
+	s, err := openSpool(cfg, metrics.NewRegistry(), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, value := range []string{"1", "2"} {
+		if err := s.append(&spooledRecord{Topic: "a", Value: []byte(value)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	name := s.path(s.segments[0].id)
+	second := s.segments[0].size / 2
+	close(s.done)
+	s.close()
+
+	// The length of the second record is not covered by its checksum.
+	f, err := os.OpenFile(name, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], 0xffffffff)
+	if _, err := f.WriteAt(length[:], second); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if s, err = openSpool(cfg, metrics.NewRegistry(), logger); err != nil {
+		t.Fatal(err)
+	}
+	runtime.ReadMemStats(&after)
+	if n := after.TotalAlloc - before.TotalAlloc; n > 1<<20 {
+		t.Errorf("got %d bytes allocated, want the length checked first", n)
+	}
+	defer func() {
+		close(s.done)
+		s.close()
+	}()
+	if s.records != 1 || s.segments[0].size != second {
+		t.Errorf("got %d records in %d bytes, want the segment truncated to the first record", s.records, s.segments[0].size)
+	}
+}
@@ -0,0 +1,265 @@
+package kawka
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	kafka "github.com/Shopify/sarama"
+)
+
+// TypeCommand is the message type reserved for the commands.
+const TypeCommand = "command"
+
+// Actions of the commands sent by clients.
+const (
+	ActionSubscribe   = "subscribe"
+	ActionUnsubscribe = "unsubscribe"
+)
+
+// Types of the replies sent to subscribed clients.
+const (
+	ReplySubscribed   = "subscribed"
+	ReplyUnsubscribed = "unsubscribed"
+	ReplyRecord       = "record"
+)
+
+// Error codes of the replies to commands.
+const (
+	// CodeBadCommand means the command is malformed.
+	CodeBadCommand = "bad_command"
+
+	// CodeSubscribeFailed means the topic cannot be consumed.
+	CodeSubscribeFailed = "subscribe_failed"
+)
+
+// Command is a control message sent by a client. It is distinguished from
+// the regular messages by the reserved type TypeCommand, the messages of
+// any other type are passed to the handler:
+//
+//	{"type": "command", "action": "subscribe", "topic": "events"}
+//
+// Partition is optional, all the partitions of the topic are consumed by
+// default. Offset is optional too, it could be kafka.OffsetOldest (-2) or
+// kafka.OffsetNewest (-1), which is the default.
+type Command struct {
+	Type      string `json:"type"`
+	ID        string `json:"id,omitempty"`
+	Action    string `json:"action"`
+	Topic     string `json:"topic"`
+	Partition *int32 `json:"partition,omitempty"`
+	Offset    *int64 `json:"offset,omitempty"`
+}
+
+// CommandReply is sent to a client when its command is done.
+type CommandReply struct {
+	Type       string  `json:"type"`
+	ID         string  `json:"id,omitempty"`
+	Topic      string  `json:"topic"`
+	Partitions []int32 `json:"partitions"`
+}
+
+// Event is a Kafka record streamed to a subscribed client.
+// Value is kept as is when it holds JSON, otherwise it is a JSON string.
+// Timestamp is in milliseconds since the epoch, it is set by Kafka 0.10+.
+type Event struct {
+	Type      string          `json:"type"`
+	Topic     string          `json:"topic"`
+	Partition int32           `json:"partition"`
+	Offset    int64           `json:"offset"`
+	Key       string          `json:"key,omitempty"`
+	Value     json.RawMessage `json:"value"`
+	Timestamp int64           `json:"timestamp,omitempty"`
+}
+
+var errNoTopic = errors.New("kawka: topic is required")
+
+// subscription identifies a consumed partition.
+type subscription struct {
+	topic     string
+	partition int32
+}
+
+// parseCommand reports whether the payload is a command.
+// The commands with an unknown action are rejected by handleCommand.
+func parseCommand(payload []byte) (*Command, bool) {
+	var cmd Command
+	if err := json.Unmarshal(payload, &cmd); err != nil || cmd.Type != TypeCommand {
+		return nil, false
+	}
+	return &cmd, true
+}
+
+func (wk *Kawka) handleCommand(c *conn, cmd *Command) {
+	var (
+		partitions []int32
+		err        error
+		code       = CodeBadCommand
+	)
+
+	switch {
+	case cmd.Topic == "":
+		err = errNoTopic
+
+	case cmd.Action == ActionSubscribe:
+		if err = wk.authorize(&c.peer, Access{Op: OpSubscribe, Topic: cmd.Topic}); err != nil {
+			code = CodeForbidden
+			break
+		}
+		if partitions, err = wk.subscribe(c, cmd); err != nil {
+			code = CodeSubscribeFailed
+		}
+
+	case cmd.Action == ActionUnsubscribe:
+		partitions = c.unsubscribe(cmd.Topic, cmd.Partition)
+
+	default:
+		err = errors.New("kawka: unknown action " + cmd.Action)
+	}
+
+	if err != nil {
+		wk.logger.Warn("error on "+cmd.Action, c.peer.keyvals("topic", cmd.Topic, "err", err)...)
+		wk.reply(c, &ErrorReply{
+			Type:    ReplyError,
+			ID:      cmd.ID,
+			Topic:   cmd.Topic,
+			Code:    code,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	reply := &CommandReply{
+		Type:       ReplySubscribed,
+		ID:         cmd.ID,
+		Topic:      cmd.Topic,
+		Partitions: partitions,
+	}
+	if cmd.Action == ActionUnsubscribe {
+		reply.Type = ReplyUnsubscribed
+	}
+	wk.reply(c, reply)
+}
+
+// subscribe starts streaming the requested partitions to c.
+// It returns the partitions that are consumed.
+func (wk *Kawka) subscribe(c *conn, cmd *Command) ([]int32, error) {
+	partitions := []int32{}
+	if cmd.Partition != nil {
+		partitions = append(partitions, *cmd.Partition)
+	} else {
+		all, err := wk.client.Partitions(cmd.Topic)
+		if err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, all...)
+	}
+
+	offset := kafka.OffsetNewest
+	if cmd.Offset != nil {
+		offset = *cmd.Offset
+	}
+
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	if c.consumer == nil {
+		consumer, err := kafka.NewConsumerFromClient(wk.client)
+		if err != nil {
+			return nil, err
+		}
+		c.consumer = consumer
+		c.subs = make(map[subscription]kafka.PartitionConsumer)
+	}
+
+	var created []subscription
+	for _, partition := range partitions {
+		sub := subscription{topic: cmd.Topic, partition: partition}
+		if _, ok := c.subs[sub]; ok {
+			continue
+		}
+
+		pc, err := c.consumer.ConsumePartition(cmd.Topic, partition, offset)
+		if err != nil {
+			for _, sub := range created {
+				c.closeSubscription(sub)
+			}
+			return nil, err
+		}
+		c.subs[sub] = pc
+		created = append(created, sub)
+
+		go wk.forward(c, pc)
+	}
+	return partitions, nil
+}
+
+// forward writes the records of pc to c until pc is closed.
+func (wk *Kawka) forward(c *conn, pc kafka.PartitionConsumer) {
+	for msg := range pc.Messages() {
+		var ts int64
+		if !msg.Timestamp.IsZero() {
+			ts = msg.Timestamp.UnixNano() / int64(time.Millisecond)
+		}
+		wk.reply(c, &Event{
+			Type:      ReplyRecord,
+			Topic:     msg.Topic,
+			Partition: msg.Partition,
+			Offset:    msg.Offset,
+			Key:       string(msg.Key),
+			Value:     jsonValue(msg.Value),
+			Timestamp: ts,
+		})
+	}
+}
+
+// unsubscribe stops streaming the given partition of the topic to c,
+// or all the partitions if partition is nil.
+// It returns the partitions that were consumed.
+func (c *conn) unsubscribe(topic string, partition *int32) []int32 {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	stopped := []int32{}
+	for sub := range c.subs {
+		if sub.topic != topic || partition != nil && sub.partition != *partition {
+			continue
+		}
+		c.closeSubscription(sub)
+		stopped = append(stopped, sub.partition)
+	}
+	return stopped
+}
+
+// unsubscribeAll stops all the subscriptions of c and its consumer.
+func (c *conn) unsubscribeAll() {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for sub := range c.subs {
+		c.closeSubscription(sub)
+	}
+	if c.consumer != nil {
+		c.consumer.Close()
+		c.consumer = nil
+	}
+}
+
+// closeSubscription must be called with c.subsMu held.
+func (c *conn) closeSubscription(sub subscription) {
+	pc, ok := c.subs[sub]
+	if !ok {
+		return
+	}
+	delete(c.subs, sub)
+	pc.AsyncClose()
+}
+
+// jsonValue returns p as is if it is a valid JSON or as a JSON string.
+func jsonValue(p []byte) json.RawMessage {
+	if json.Valid(p) {
+		return p
+	}
+	v, _ := json.Marshal(string(p))
+	return v
+}
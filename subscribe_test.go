@@ -0,0 +1,22 @@
+package kawka
+
+import "testing"
+
+func TestParseCommand(t *testing.T) {
+	for _, test := range []struct {
+		payload string
+		command bool
+	}{
+		{`{"type":"command","action":"subscribe","topic":"events"}`, true},
+		{`{"type":"command","action":"rewind","topic":"events"}`, true},
+		{`{"type":"click","action":"buy","topic":"events"}`, false},
+		{`{"action":"subscribe","topic":"events"}`, false},
+		{`{"type":"Command","action":"subscribe"}`, false},
+		{`["command"]`, false},
+		{`command`, false},
+	} {
+		if _, ok := parseCommand([]byte(test.payload)); ok != test.command {
+			t.Errorf("%s: got command %v, want %v", test.payload, ok, test.command)
+		}
+	}
+}
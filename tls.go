@@ -0,0 +1,148 @@
+package kawka
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// certCheckInterval is how often certificate files are checked for changes.
+const certCheckInterval = 10 * time.Second
+
+// certReloader holds a TLS key pair and reloads it when the files change
+// on disk, so rotated certificates take effect without a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   Logger
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+	checked time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// load reads the key pair from disk. The caller must hold r.mu or be the
+// only user of r.
+func (r *certReloader) load() error {
+	modTime, err := r.lastModified()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	r.cert = &cert
+	r.modTime = modTime
+	r.checked = time.Now()
+	return nil
+}
+
+// lastModified returns the latest modification time of the key pair files.
+func (r *certReloader) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{r.certFile, r.keyFile} {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+// If the files cannot be reloaded the previous key pair is kept.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if time.Since(r.checked) < certCheckInterval {
+		return r.cert, nil
+	}
+	r.checked = time.Now()
+
+	modTime, err := r.lastModified()
+	if err != nil {
+		r.logger.Error("error on certificate reload", "cert", r.certFile, "err", err)
+		return r.cert, nil
+	}
+	if !modTime.After(r.modTime) {
+		return r.cert, nil
+	}
+	if err := r.load(); err != nil {
+		r.logger.Error("error on certificate reload", "cert", r.certFile, "err", err)
+	}
+	return r.cert, nil
+}
+
+// loadCertPool reads PEM encoded certificates from caFile.
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("kawka: no certificates found in " + caFile)
+	}
+	return pool, nil
+}
+
+// KafkaTLS configures TLS connections to the Kafka brokers.
+type KafkaTLS struct {
+	// CAFile holds the certificates of the CAs verifying the brokers.
+	// The system pool is used if empty.
+	CAFile string
+
+	// CertFile and KeyFile are the optional client key pair.
+	CertFile string
+	KeyFile  string
+
+	// ServerName overrides the host name checked in the broker certificates.
+	ServerName string
+
+	// InsecureSkipVerify turns off the verification of the brokers,
+	// it must be used for testing only.
+	InsecureSkipVerify bool
+}
+
+func (cfg KafkaTLS) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+	if cfg.CAFile != "" {
+		pool, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}